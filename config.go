@@ -0,0 +1,276 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"strings"
+	"time"
+
+	lib "github.com/restlessbandit/ldbrest/libldbrest"
+	"github.com/ugorji/go/codec"
+)
+
+// config is the contents of a -config file. Everything in it is optional.
+type config struct {
+	Listen      []string               `codec:"listen"`
+	DB          string                 `codec:"db"`
+	Follow      string                 `codec:"follow"`
+	FollowToken string                 `codec:"follow_token"`
+	Options     map[string]interface{} `codec:"options"`
+	Databases   map[string]*dbSpec     `codec:"databases"`
+
+	Limits struct {
+		MaxResults int `codec:"max_results"`
+		MaxKeys    int `codec:"max_keys"`
+		MaxBatch   int `codec:"max_batch"`
+	} `codec:"limits"`
+
+	ChangeLog struct {
+		Count *int   `codec:"count"`
+		Age   string `codec:"age"`
+	} `codec:"changelog"`
+
+	Auth struct {
+		Tokens     []string `codec:"tokens"`
+		ReadTokens []string `codec:"read_tokens"`
+	} `codec:"auth"`
+}
+
+// the keys allowed in a config file, and in each of its sections
+var configKeys = map[string][]string{
+	"":          {"listen", "db", "follow", "follow_token", "options", "databases", "limits", "changelog", "auth"},
+	"databases": {"path", "follow", "options"},
+	"limits":    {"max_results", "max_keys", "max_batch"},
+	"changelog": {"count", "age"},
+	"auth":      {"tokens", "read_tokens"},
+}
+
+var jsonHandle = &codec.JsonHandle{}
+
+func init() {
+	jsonHandle.MapType = reflect.TypeOf(map[string]interface{}(nil))
+}
+
+// loadConfig reads a config file and applies it. Anything set by a flag in
+// given (keyed by flag name) is left alone, as flags override the file.
+func loadConfig(path string, given map[string]string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := checkConfigKeys(b); err != nil {
+		return err
+	}
+
+	cfg := &config{}
+	if err := codec.NewDecoderBytes(b, jsonHandle).Decode(cfg); err != nil {
+		return err
+	}
+
+	if cfg.Options != nil {
+		ob := make([]byte, 0)
+		if err := codec.NewEncoderBytes(&ob, jsonHandle).Encode(cfg.Options); err != nil {
+			return err
+		}
+		if lib.Options, err = lib.ParseOptions(ob); err != nil {
+			return fmt.Errorf("options: %s", err)
+		}
+	}
+
+	// lists from flags replace those in the file rather than adding to them
+	_, s := given["s"]
+	_, serveaddr := given["serveaddr"]
+	if cfg.Listen != nil && !s && !serveaddr {
+		serveAddrs = addrlist(cfg.Listen)
+	}
+	if _, ok := given["auth-token"]; cfg.Auth.Tokens != nil && !ok {
+		lib.AuthTokens = cfg.Auth.Tokens
+	}
+	if _, ok := given["read-token"]; cfg.Auth.ReadTokens != nil && !ok {
+		lib.ReadTokens = cfg.Auth.ReadTokens
+	}
+
+	if cfg.DB != "" {
+		dbPath = cfg.DB
+	}
+	for name, spec := range cfg.Databases {
+		if spec == nil {
+			spec = &dbSpec{}
+		}
+		// a -db flag's path wins, but the rest still comes from the file
+		if given := databases[name]; given != nil {
+			spec.Path = given.Path
+		}
+		databases[name] = spec
+	}
+	if cfg.Follow != "" {
+		followURL = cfg.Follow
+	}
+	if cfg.FollowToken != "" {
+		lib.FollowToken = cfg.FollowToken
+	}
+
+	if cfg.Limits.MaxResults != 0 {
+		lib.ABSMAX = cfg.Limits.MaxResults
+	}
+	if cfg.Limits.MaxKeys != 0 {
+		lib.KEYSMAX = cfg.Limits.MaxKeys
+	}
+	if cfg.Limits.MaxBatch != 0 {
+		lib.MaxBatchOps = cfg.Limits.MaxBatch
+	}
+
+	if cfg.ChangeLog.Count != nil {
+		lib.ChangeLogMaxCount = *cfg.ChangeLog.Count
+	}
+	if cfg.ChangeLog.Age != "" {
+		if lib.ChangeLogMaxAge, err = time.ParseDuration(cfg.ChangeLog.Age); err != nil {
+			return fmt.Errorf("changelog age: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// checkConfigKeys catches misspelled keys, which would otherwise just be
+// ignored
+func checkConfigKeys(b []byte) error {
+	fields := map[string]interface{}{}
+	if err := codec.NewDecoderBytes(b, jsonHandle).Decode(&fields); err != nil {
+		return err
+	}
+
+	if err := checkKeys("", fields); err != nil {
+		return err
+	}
+	for section := range configKeys {
+		if sub, ok := fields[section].(map[string]interface{}); ok && section != "" && section != "databases" {
+			if err := checkKeys(section, sub); err != nil {
+				return err
+			}
+		}
+	}
+
+	// "databases" holds a section for each database, by name
+	dbs, _ := fields["databases"].(map[string]interface{})
+	for name := range dbs {
+		if sub, ok := dbs[name].(map[string]interface{}); ok {
+			if err := checkKeys("databases", sub); err != nil {
+				return fmt.Errorf("database %q: %s", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// options are the global leveldb options, with any of the database's own
+// on top
+func (ds *dbSpec) options() (lib.DBOptions, error) {
+	if ds.Options == nil {
+		return lib.Options, nil
+	}
+	return mergeOptions(lib.Options, ds.Options)
+}
+
+// loadOptionsFile reads an -options file, laying its options over the ones
+// there are already (from the config file)
+func loadOptionsFile(path string) (lib.DBOptions, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return lib.DBOptions{}, err
+	}
+	// catches misspelled names
+	if _, err := lib.ParseOptions(b); err != nil {
+		return lib.DBOptions{}, fmt.Errorf("%s: %s", path, err)
+	}
+
+	over := map[string]interface{}{}
+	if err := codec.NewDecoderBytes(b, jsonHandle).Decode(&over); err != nil {
+		return lib.DBOptions{}, err
+	}
+	return mergeOptions(lib.Options, over)
+}
+
+// mergeOptions lays options by name over the top of base
+func mergeOptions(base lib.DBOptions, over map[string]interface{}) (lib.DBOptions, error) {
+	b := make([]byte, 0)
+	if err := codec.NewEncoderBytes(&b, jsonHandle).Encode(&base); err != nil {
+		return lib.DBOptions{}, err
+	}
+	merged := map[string]interface{}{}
+	if err := codec.NewDecoderBytes(b, jsonHandle).Decode(&merged); err != nil {
+		return lib.DBOptions{}, err
+	}
+	for name, val := range over {
+		merged[name] = val
+	}
+
+	b = b[:0]
+	if err := codec.NewEncoderBytes(&b, jsonHandle).Encode(merged); err != nil {
+		return lib.DBOptions{}, err
+	}
+	return lib.ParseOptions(b)
+}
+
+func checkKeys(section string, fields map[string]interface{}) error {
+	for name := range fields {
+		var known bool
+		for _, key := range configKeys[section] {
+			known = known || key == name
+		}
+		if !known && section == "" {
+			return fmt.Errorf("unknown config key %q", name)
+		} else if !known {
+			return fmt.Errorf("unknown config key %q in %q", name, section)
+		}
+	}
+	return nil
+}
+
+// validateConfig checks the complete configuration, from the config file and
+// flags together
+func validateConfig() error {
+	if dbPath == "" && len(databases) == 0 {
+		return errors.New("missing db path")
+	}
+	if err := lib.Options.Validate(); err != nil {
+		return fmt.Errorf("bad leveldb options: %s", err)
+	}
+
+	for _, name := range databases.names() {
+		spec := databases[name]
+		if name == "" || strings.Contains(name, "/") {
+			return fmt.Errorf("bad database name %q", name)
+		}
+		if spec.Path == "" {
+			return fmt.Errorf("missing path for database %q", name)
+		}
+
+		opts, err := spec.options()
+		if err == nil {
+			err = opts.Validate()
+		}
+		if err != nil {
+			return fmt.Errorf("bad leveldb options for database %q: %s", name, err)
+		}
+	}
+
+	for _, addr := range serveAddrs {
+		if strings.Contains(addr, ":") {
+			if _, _, err := net.SplitHostPort(addr); err != nil {
+				return fmt.Errorf("bad serve address: %s", err)
+			}
+		}
+	}
+
+	if lib.ABSMAX <= 0 || lib.KEYSMAX <= 0 || lib.MaxBatchOps <= 0 {
+		return errors.New("limits must be positive")
+	}
+	if lib.ChangeLogMaxCount < 0 || lib.ChangeLogMaxAge < 0 {
+		return errors.New("changelog limits must not be negative")
+	}
+	return nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	lib "github.com/restlessbandit/ldbrest/libldbrest"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir := setupConfig(t)
+	defer cleanupConfig(dir)
+
+	path := writeFile(t, dir, "config.json", `{
+		"listen": ["127.0.0.1:7001", "/tmp/ldbrest.sock"],
+		"db": "/path/to/db",
+		"follow": "http://primary:7000",
+		"follow_token": "ft",
+		"options": {"block_size": 8192, "compression": "none"},
+		"databases": {
+			"users": {"path": "/path/to/users", "options": {"block_size": 16384}},
+			"events": {"path": "/path/to/events", "follow": "http://primary:7000/db/events"}
+		},
+		"limits": {"max_results": 10, "max_keys": 20, "max_batch": 30},
+		"changelog": {"count": 0, "age": "1h"},
+		"auth": {"tokens": ["t1"], "read_tokens": ["r1", "r2"]}
+	}`)
+
+	if err := loadConfig(path, map[string]string{}); err != nil {
+		t.Fatal(err)
+	}
+
+	assert(t, strings.Join(serveAddrs, ",") == "127.0.0.1:7001,/tmp/ldbrest.sock", "wrong listen addresses: %v", serveAddrs)
+	assert(t, dbPath == "/path/to/db", "wrong db path: %s", dbPath)
+	assert(t, followURL == "http://primary:7000" && lib.FollowToken == "ft", "wrong follow settings: %s %s", followURL, lib.FollowToken)
+	assert(t, lib.Options.BlockSize == 8192 && lib.Options.Compression == "none", "wrong options: %+v", lib.Options)
+	assert(t, lib.ABSMAX == 10 && lib.KEYSMAX == 20 && lib.MaxBatchOps == 30, "wrong limits: %d %d %d", lib.ABSMAX, lib.KEYSMAX, lib.MaxBatchOps)
+	assert(t, lib.ChangeLogMaxCount == 0 && lib.ChangeLogMaxAge == time.Hour, "wrong changelog limits: %d %s", lib.ChangeLogMaxCount, lib.ChangeLogMaxAge)
+	assert(t, strings.Join(lib.AuthTokens, ",") == "t1", "wrong auth tokens: %v", lib.AuthTokens)
+	assert(t, strings.Join(lib.ReadTokens, ",") == "r1,r2", "wrong read tokens: %v", lib.ReadTokens)
+
+	assert(t, strings.Join(databases.names(), ",") == "events,users", "wrong databases: %v", databases.names())
+	assert(t, databases["events"].Follow == "http://primary:7000/db/events", "lost a database's follow: %+v", databases["events"])
+	opts, err := databases["users"].options()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, opts.BlockSize == 16384 && opts.Compression == "none", "database options weren't laid over the top-level ones: %+v", opts)
+}
+
+func TestLoadConfigGivenFlags(t *testing.T) {
+	dir := setupConfig(t)
+	defer cleanupConfig(dir)
+
+	path := writeFile(t, dir, "config.json", `{
+		"listen": ["127.0.0.1:7001"],
+		"databases": {"users": {"path": "/path/to/users", "follow": "http://primary:7000"}},
+		"auth": {"tokens": ["t1"]}
+	}`)
+
+	// as if given -s, -auth-token and -db
+	serveAddrs = addrlist{"127.0.0.1:7002"}
+	lib.AuthTokens = []string{"flag"}
+	databases.Set("users=/elsewhere")
+	given := map[string]string{"s": "127.0.0.1:7002", "auth-token": "flag", "db": "users=/elsewhere"}
+
+	if err := loadConfig(path, given); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, strings.Join(serveAddrs, ",") == "127.0.0.1:7002", "file replaced -s: %v", serveAddrs)
+	assert(t, strings.Join(lib.AuthTokens, ",") == "flag", "file replaced -auth-token: %v", lib.AuthTokens)
+	assert(t, databases["users"].Path == "/elsewhere", "file replaced a -db path: %s", databases["users"].Path)
+	assert(t, databases["users"].Follow == "http://primary:7000", "-db lost the rest of the file's database: %+v", databases["users"])
+}
+
+func TestCheckConfigKeys(t *testing.T) {
+	for _, c := range []struct {
+		config, err string
+	}{
+		{`{"db": "/path", "limits": {"max_keys": 1}, "databases": {"a": {"path": "/a"}}}`, ""},
+		{`{"dbs": "/path"}`, `unknown config key "dbs"`},
+		{`{"limits": {"max_key": 1}}`, `unknown config key "max_key" in "limits"`},
+		{`{"auth": {"token": ["t"]}}`, `unknown config key "token" in "auth"`},
+		{`{"databases": {"a": {"pth": "/a"}}}`, `database "a": unknown config key "pth" in "databases"`},
+	} {
+		err := checkConfigKeys([]byte(c.config))
+		if c.err == "" {
+			assert(t, err == nil, "%s: unexpected error: %v", c.config, err)
+		} else {
+			assert(t, err != nil && err.Error() == c.err, "%s: wrong error: %v", c.config, err)
+		}
+	}
+
+	err := checkConfigKeys([]byte(`{"db": `))
+	assert(t, err != nil, "bad JSON wasn't an error")
+}
+
+func TestValidateConfig(t *testing.T) {
+	dir := setupConfig(t)
+	defer cleanupConfig(dir)
+
+	for _, c := range []struct {
+		name  string
+		set   func()
+		valid bool
+	}{
+		{"positional db", func() { dbPath = "/path" }, true},
+		{"named db", func() { databases["a"] = &dbSpec{Path: "/a"} }, true},
+		{"no db", func() {}, false},
+		{"bad options", func() {
+			dbPath = "/path"
+			lib.Options.Compression = "lz4"
+		}, false},
+		{"bad database name", func() { databases["a/b"] = &dbSpec{Path: "/a"} }, false},
+		{"database without a path", func() { databases["a"] = &dbSpec{} }, false},
+		{"bad database options", func() {
+			databases["a"] = &dbSpec{Path: "/a", Options: map[string]interface{}{"block_size": -1}}
+		}, false},
+		{"bad serve address", func() {
+			dbPath = "/path"
+			serveAddrs = addrlist{"127.0.0.1:70:00"}
+		}, false},
+		{"zero limit", func() {
+			dbPath = "/path"
+			lib.MaxBatchOps = 0
+		}, false},
+		{"negative changelog age", func() {
+			dbPath = "/path"
+			lib.ChangeLogMaxAge = -time.Hour
+		}, false},
+	} {
+		resetConfig()
+		c.set()
+		err := validateConfig()
+		assert(t, (err == nil) == c.valid, "%s: wrong validity: %v", c.name, err)
+	}
+}
+
+func TestFlagsOverrideFiles(t *testing.T) {
+	dir := setupConfig(t)
+	defer cleanupConfig(dir)
+
+	config := writeFile(t, dir, "config.json", `{
+		"db": "/path/from/config",
+		"options": {"block_size": 8192, "compression": "none", "bloom_filter_bits": 5},
+		"limits": {"max_results": 50, "max_keys": 60}
+	}`)
+	options := writeFile(t, dir, "options.json", `{"block_size": 16384}`)
+
+	parseArgs("-config", config, "-options", options, "-max-results", "7", "-bloom-filter-bits", "10", "/path/from/flag")
+
+	assert(t, dbPath == "/path/from/flag", "positional db path didn't win: %s", dbPath)
+	assert(t, lib.ABSMAX == 7, "-max-results didn't win: %d", lib.ABSMAX)
+	assert(t, lib.KEYSMAX == 60, "lost max_keys from the config: %d", lib.KEYSMAX)
+	assert(t, lib.Options.BlockSize == 16384, "-options file didn't win: %+v", lib.Options)
+	assert(t, lib.Options.Compression == "none", "-options file replaced the config's options: %+v", lib.Options)
+	assert(t, lib.Options.BloomFilterBits == 10, "-bloom-filter-bits didn't win: %+v", lib.Options)
+	assert(t, validateConfig() == nil, "flags and files together should be valid")
+}
+
+// the defaults of everything the configuration sets
+var (
+	defaultLimits        = [3]int{lib.ABSMAX, lib.KEYSMAX, lib.MaxBatchOps}
+	defaultChangeLogSize = lib.ChangeLogMaxCount
+	defaultChangeLogAge  = lib.ChangeLogMaxAge
+)
+
+func resetConfig() {
+	databases = dblist{}
+	serveAddrs = nil
+	followURL = ""
+	optionsPath = ""
+	configPath = ""
+	checkConfig = false
+	dbPath = ""
+
+	lib.Options = lib.DBOptions{}
+	lib.AuthTokens = nil
+	lib.ReadTokens = nil
+	lib.FollowToken = ""
+	lib.ABSMAX, lib.KEYSMAX, lib.MaxBatchOps = defaultLimits[0], defaultLimits[1], defaultLimits[2]
+	lib.ChangeLogMaxCount = defaultChangeLogSize
+	lib.ChangeLogMaxAge = defaultChangeLogAge
+}
+
+func setupConfig(tb testing.TB) string {
+	resetConfig()
+	dir, err := ioutil.TempDir("", "ldbrest_config_test")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return dir
+}
+
+func cleanupConfig(dir string) {
+	resetConfig()
+	os.RemoveAll(dir)
+}
+
+// parseArgs runs parseFlags on a command line, with a fresh set of flags
+func parseArgs(args ...string) {
+	defer func(args []string, fs *flag.FlagSet) {
+		os.Args, flag.CommandLine = args, fs
+	}(os.Args, flag.CommandLine)
+
+	os.Args = append([]string{"ldbrest"}, args...)
+	flag.CommandLine = flag.NewFlagSet("ldbrest", flag.PanicOnError)
+	parseFlags()
+}
+
+func writeFile(tb testing.TB, dir, name, contents string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		tb.Fatal(err)
+	}
+	return path
+}
+
+func assert(tb testing.TB, cond bool, msg string, args ...interface{}) {
+	if !cond {
+		tb.Fatalf(msg, args...)
+	}
+}
@@ -8,24 +8,116 @@ from an operational standpoint is that a single database can only be open
 These properties make it perfect for a simple REST server offering CRUD
 operations on keys. ldbrest exposes a few other useful endpoints as well.
 
-It is invoked with an optional -s/-serveaddr flag and a required positional
-/path/to/leveldb. "serveaddr" can be a "host:port" for TCP or a
+It is invoked with an optional -s/-serveaddr flag and a positional
+/path/to/leveldb (required unless it's in a config file or there are -db
+flags, see below). "serveaddr" can be a "host:port" for TCP or a
 /path/to/socketfile for a streaming unix domain socket and can be given more
 than once. Without any -s/-serveaddr flags it will serve on "127.0.0.1:7000".
 
+The leveldb database is opened with leveldb's default options unless told
+otherwise with these flags (in bytes where they're sizes):
+-block-cache-size, -block-size, -write-buffer, -compaction-table-size,
+-max-open-files, -bloom-filter-bits (bits per key, default 0 for no bloom
+filter), -compression ("snappy" or "none") and -strict ("default", "all" or
+"none"). They may also be given in a JSON file named by an -options flag, as
+an object with the same names but with underscores ("block_cache_size"), in
+which case any of the flags also given on the command line win. Invalid
+options stop ldbrest from starting.
+
+One process can serve more than one database. Each -db name=/path/to/leveldb
+flag (which may be given more than once) opens another, with all of its
+endpoints under /db/<name>, so that its keys are at /db/<name>/key/<key> and
+so on. The positional database, if there is one, is still served at the root.
+Each database has its own keys, snapshots, change log and properties, and is
+opened with the options above unless the config file (see below) gives it
+options of its own.
+
+Limits on how much a single request can ask for are set with -max-results
+(records in a page of results, default 1000), -max-keys (bare keys in a page,
+or ranges in POST /sizes, default 10000) and -max-batch (ops in a batch or
+increment, default 10000).
+
+Requests may be made to need a bearer token ("Authorization: Bearer
+<token>"), given with -auth-token for tokens that allow anything and
+-read-token for ones that only allow reads. Either may be given more than
+once. Without a valid token requests get a 401 ("Unauthorized"), and with a
+read token anything but a read gets a 403 ("Forbidden"). A follower (see
+below) sends the token given with -follow-token to its primary.
+
+All of this may instead come from a JSON config file named with a -config
+flag, such as:
+
+  {
+    "listen": ["127.0.0.1:7000", "/tmp/ldbrest.sock"],
+    "db": "/path/to/leveldb",
+    "follow": "http://primary:7000",
+    "follow_token": "...",
+    "options": {"block_cache_size": 67108864, "bloom_filter_bits": 10},
+    "databases": {
+      "users": {"path": "/path/to/users", "options": {"compression": "none"}},
+      "events": {
+        "path": "/path/to/events",
+        "follow": "http://primary:7000/db/events"
+      }
+    },
+    "limits": {"max_results": 1000, "max_keys": 10000, "max_batch": 10000},
+    "changelog": {"count": 100000, "age": "24h"},
+    "auth": {"tokens": ["..."], "read_tokens": ["..."]}
+  }
+
+Everything in it is optional, and unknown keys are an error. A database's
+"options" are laid over the top-level ones, as are those in an -options file,
+and its "follow" makes just that database a follower. Flags given on the
+command line take precedence over the file (a list flag like -s replaces the
+file's list rather than adding to it), and so does a positional db path. A -db
+flag for a database named in the file replaces only its path. With
+-check-config ldbrest validates the configuration and exits, with a non-zero
+status if there's anything wrong.
+
+Request and response bodies are msgpack by default, but JSON, CBOR and Binc
+are also supported. The format of a request body is picked by its
+Content-Type ("application/msgpack", "application/json", "application/cbor"
+or "application/x-binc"), and that of a response body by the Accept header.
+Anything else gets a 415 ("Unsupported Media Type") or 406 ("Not Acceptable")
+respectively, and a request that will get a 406 is turned away before it has
+any effect. Wherever "msgpack" is mentioned below, any of these will do.
+
 The server offers these endpoints:
 
   GET /key/<name>
-Returns the value associated with the <name> key in the response body with
-content-type text/plain (or 404s).
+Returns a msgpack object with "key" and "value" keys for the <name> key (or
+404s). With a "raw=yes" query parameter, or an Accept header preferring
+"application/octet-stream", the response body is instead just the bare value
+with content-type application/octet-stream.
+
+  PUT /key/<name>
+Stores the request body verbatim as the value of the <name> key, then returns
+a 204. An expiry may be given with "ttl" or "expires_at" query string
+parameters (see below).
 
   POST /key
 Takes a msgpack object with "key" and "value" keys and stores them in the
-database, then returns a 204.
+database, then returns a 204. The object may also have a "ttl" (a number of
+seconds) or "expires_at" (a unix timestamp) to make the key expire.
+
+Once a key has expired it is hidden from every endpoint, and a background
+reaper deletes expired keys every 10 seconds. Writing a key without an expiry
+removes any expiry it had. ldbrest keeps its own bookkeeping for this under
+keys beginning with "\xff\xff\xff\xffldbrest:", which are hidden in the same
+way, and can't be written by clients.
 
   DELETE /key/<name>
 Deletes the key <name> and returns a 204.
 
+PUT and POST /key and DELETE /key/<name> honor "If-Match" and
+"If-None-Match" request headers, making it possible to compare-and-swap a
+key. Values' ETags come from GET /key/<name> (and successful writes) in the
+"ETag" response header, and "*" matches any existing key, so for instance
+"If-None-Match: *" will only create a new key. If the current value doesn't
+satisfy them, nothing is written and the response is a 412 ("Precondition
+Failed"). Checking and writing happen together under a lock, so concurrent
+conditional writes can't both succeed.
+
   POST /keys
 Retrieves all of a group of keys in one endpoint. It takes a msgpack request
 body with a single key "keys", which should be an array of the string keys to
@@ -35,6 +127,9 @@ The response is application/msgpack with a single key "data", an array of
 objects with "key" and "value" keys. Any keys from the request that were not
 found in the database are simply omitted from the response.
 
+An optional "fields" query parameter of "keys" or "values" leaves the other
+half out of each object in "data" (default "both").
+
 This endpoint doesn't actually change any server-side data, but the POST is
 necessary to ensure that a request body makes it through.
 
@@ -55,31 +150,256 @@ it exists (default "yes")
 * "include_end" is whether to include the key precisely matching "end" if it
 exists (default "no")
 
+* "prefix" restricts iteration to keys beginning with it. It may be combined
+with any of the other parameters, in which case "start" should fall within
+the prefix (default no restriction)
+
 * "max" is a maximum number of keys(/values) to return, this can be provided
 in conjunction with "end" in which case either condition would terminate
 iteration (default 1000, higher values than this will be ignored)
 
-It then returns a msgpack object with two keys "more" and "data". "data" is an
-array of objects, while "more" is false unless "end" was provided but "max"
-caused the end of iteration (there was still more to go before we would have
-hit "end").
+* "fields" may be "keys" or "values" to return only that half of each pair
+(default "both"). Keys-only requests may use a "max" of up to 10,000
+
+* "stream" set to "yes" sends the records back one after another as they are
+read (with chunked transfer encoding) instead of as a single object. In this
+mode "max" defaults to unlimited and isn't capped at 1000. Streams of JSON
+are sent as newline-delimited JSON with content-type application/x-ndjson
+
+* "cursor" is a token from a previous response, and picks iteration back up
+exactly where that one left off. It stands in for all of the above except
+"max".
+
+Unless streaming, it then returns a msgpack object with keys "more", "cursor"
+and "data". "data" is an array of objects, while "more" is true only if "max"
+caused the end of iteration and there were still more keys to go (before
+"end", if it was provided). In that case "cursor" is an opaque string that can
+be passed back to fetch the next page.
+
+  GET /count
+Counts the keys in a range. It takes the same "forward", "start",
+"include_start", "end", "include_end", "prefix" and "cursor" query string
+parameters as /iterate, and walks the range from a point-in-time snapshot.
+It returns a msgpack object with keys "count" and "approximate".
+
+With "approximate=yes" it only reads the first 1,000 keys, and estimates the
+rest from the range's size on disk. "approximate" in the response says
+whether that happened, as small ranges still get an exact count. So do
+ranges whose first keys were written too recently to be on disk yet, as
+there is nothing to estimate from.
+
+  POST /sizes
+Estimates how much disk space ranges of keys take up. The msgpack request
+body has key "ranges", an array of objects with "start" and "end", or
+"prefix", keys (at most 10,000 of them). It returns a msgpack object with key
+"data", the same array with "size" added to each, in bytes.
+
+Alternatively the request body may have key "delimiter" instead, to find
+which prefixes take up the most space. The keys are grouped by where they
+first contain the delimiter (after an optional "prefix"), so that with "/",
+"users/1" and "users/2" are both in the "users/" group. A key without the
+delimiter is a group of its own. The response has the "top" (default 10, at
+most 1000) groups by size, largest first, each with keys "prefix" and "size".
+
+The sizes come from leveldb, so they are only estimates, are of the data as
+compressed on disk, and leave out the most recent writes.
+
+  DELETE /range
+Deletes every key in a range, given by the same query string parameters as
+/count, though at least one of "start", "end" or "prefix" is required. The
+deletes are written in batches of 1,000, and a msgpack object is returned
+with key "deleted", the number of keys removed. With "compact=yes" the
+cleared range is compacted afterwards to reclaim the disk space, and with
+"log=no" the deletes skip the change log (see GET /changes).
 
   POST /batch
 Applies a batch of updates atomically. It accepts a msgpack request body with
 key "ops", an array of objects with keys "op", "key", and "value". "op" may be
-"put" or "delete", in the latter case "value" may be omitted.
+"put" or "delete", in the latter case "value" may be omitted. "put" ops may
+also have a "ttl" or "expires_at", as in POST /key.
+
+"op" may also be one of the checks "check_equals" (the key's current value is
+"value"), "check_present" or "check_absent". All checks are evaluated against
+the current data before anything is written, and if any of them fail the
+whole batch is abandoned with a 409 ("Conflict"). The body of that response
+is a msgpack object describing the first failed check, with keys "index",
+"op", "key" and "reason".
 
 It will refuse to process batches with more than 10,000 items with a 413
 ("Request Entity Too Large").
 
+  POST /incr/<name>
+Atomically adds the integer in the "delta" query string parameter (default 1)
+to the value of the <name> key, and returns a msgpack object with keys "key"
+and "value", the new integer value. Values are stored as decimal strings, and
+missing keys start at zero. If the key exists but doesn't hold an integer, or
+the sum would overflow a signed 64-bit integer, it is left alone and the
+response is a 409 ("Conflict").
+
+  POST /incr
+The batch form of the above. It takes a msgpack request body with key
+"incrs", an array of objects with keys "key" and "value" (the delta), and
+returns a msgpack object with key "data", an array of the same with the new
+values. The increments are applied all together or not at all.
+
+  GET /export
+Streams the keys of a range in a portable format for loading into another
+ldbrest with POST /import. It takes the same range query string parameters as
+GET /iterate (but no "max"), and reads from a point-in-time snapshot.
+
+The response is a stream of msgpack objects (or newline-delimited JSON, as
+with "stream=yes" on GET /iterate). The first is a header with keys "format"
+("ldbrest-export"), "version" (1) and "created" (a unix timestamp). Then comes
+one for each key, with keys "key", "value", "expires_at" (if it has an expiry)
+and "crc". That is the CRC-32 (IEEE) of the key's length as a big-endian
+32-bit integer, the key, the value, and the expiry (or 0) as a big-endian
+64-bit integer. Last is a trailer with key "count", the number of keys. An
+export that fails part way is cut off without its trailer.
+
+  POST /import
+Loads a request body holding any number of records one after another, each
+an object with keys "key" and "value" and optionally "ttl" or "expires_at".
+The body may be a msgpack stream, or newline-delimited JSON with content-type
+"application/x-ndjson". It may also be the output of GET /export, in which
+case the checksums and the trailer are checked as well. The records are read
+as they arrive and written in batches of 1,000, so the body can be as large
+as you like.
+
+A query string parameter "existing" picks what happens to a record for a key
+that already exists: "overwrite" it (the default), "skip" it, or "reject" it,
+which stops the import there. With "log=no" the records skip the change log
+(see GET /changes), which is worth it for large imports.
+
+It returns a msgpack object with keys "imported" and "skipped", the numbers of
+records written and skipped. An import is not all-or-nothing: one that stops
+early because of a rejected key (409, "Conflict") or an invalid record (400)
+has written every record before that one, and none after. Its response also
+has keys "offset", the 0-based position of the record it stopped at, and
+"error".
+
+  GET /watch
+Streams changes to keys as server-sent events (content-type
+text/event-stream). Each write becomes one event per key it touches, named
+"put" or "delete", with JSON data holding "op" and "key". Optional query
+string parameters are "prefix", which restricts events to keys beginning
+with it, and "values=yes" to include the "value" of puts.
+
+Watchers never hold up writes. One that falls more than 1,000 events behind
+is sent a final "dropped" event and disconnected. So is every watcher when
+keys change without being logged (see DELETE /range and POST /import), as
+there are no events for those. The "dropped" event's data says which.
+
+  GET /changes
+Reads the change log, in which every write is recorded with a sequence
+number. It takes optional query string parameters "since", a sequence number
+after which to start (default 0, from the beginning) and "max" (default 1000,
+higher values than this will be ignored).
+
+It returns a msgpack object with keys "changes" and "last". "changes" is an
+array of objects with keys "seq", "time" (a unix timestamp), "op" ("put" or
+"delete"), "key", "value", "expires_at" (when the put had an expiry) and
+"txn", and "last" is the latest sequence number overall. "txn" is the
+sequence number of the last change made by the same request, as a batch's
+changes all happen at once.
+
+The change log retains only the most recent changes, configured with the
+-changelog-count (default 100,000) and -changelog-age (default no limit)
+flags. Asking for changes that have already been pruned gets a 410 ("Gone")
+with a msgpack object with keys "error" and "first", the earliest sequence
+number still available.
+
+Logging every write has a cost: each put is written a second time, value and
+all, and stays on disk in the log until it's pruned. Deletes only record
+their key. DELETE /range and POST /import can skip the log with "log=no", in
+which case the log is cut off before their writes instead, and watchers are
+dropped rather than sent them. Reading changes from before then gets a 410,
+and followers copy everything over again.
+
   GET /property/<name>
 Gets and returns the leveldb property in the text/plain 200 response body, or
 404s if it isn't a valid property name.
 
+  GET /options
+Returns a msgpack object of the leveldb options the database was opened
+with, with the same keys as an -options file and leveldb's defaults filled in
+for any that weren't set.
+
+  POST /compact
+Starts compacting the database in the background, so that the space taken by
+deleted and overwritten keys is reclaimed, and returns a 202 ("Accepted")
+with the same status object as GET /compact. The range to compact may be
+limited with the same query string parameters as GET /iterate; without any
+it is the whole database. Only one compaction runs at a time, and asking for
+another meanwhile gets a 409 ("Conflict").
+
+  GET /compact
+Reports on the latest compaction from POST /compact, with a msgpack object
+with keys "running", "start" and "limit" (the bounds of the range, if any),
+"started" and "finished" (unix timestamps), "error" (if it failed), and
+"size_before" and "size", the total bytes in the database's table files
+when it began and now.
+
   POST /snapshot
 Needs a msgpack request body with key "destination", which should be a file
 system path. ldbrest will make a complete copy of the database at that
-location, then return a 204 (after what might be a while).
+location, then return a 204.
+
+An optional "mode" key picks how. The default "checkpoint" hard-links the
+database's table files (copying them instead if the destination is on
+another filesystem) along with copies of its journal and manifest, which
+takes seconds even for a large database. Writes are only held up while the
+journal and manifest are copied, and the database's files aren't removed by
+compactions until it's done, so the copy is consistent.
+The destination must not already exist. Should the checkpoint keep racing
+compactions, or with a "mode" of "logical", it instead copies every key into
+a new database at the destination, which can take a good while. Any other
+failure (an existing destination, say) is returned as a 500.
+
+  GET /snapshot.tar
+Sends a checkpoint of the database, as POST /snapshot makes, as a tar archive
+of the database's files (content-type application/x-tar). It is streamed
+straight from the database's own files, with no copy made first, and the files
+are kept from removal by compactions until the download is done. Extracting it
+into an empty directory gives a database that ldbrest can serve. With a
+"gzip=yes" query string parameter the archive is gzipped (content-type
+application/gzip).
+
+  POST /snapshots
+Takes a point-in-time snapshot of the database to read from across several
+requests, and returns a msgpack object with keys "id" and "lease". GET
+/key/<name>, POST /keys, GET /iterate, GET /count and GET /export will all
+read from the snapshot when given its id in a "snapshot" query string
+parameter (or 410 if it is gone).
+
+The snapshot is released once it goes unused for "lease" seconds, which may
+be set with a "lease" query string parameter (default 60, at most 3600).
+
+  DELETE /snapshots/<id>
+Releases a snapshot from POST /snapshots, then returns a 204 (or 404s).
+
+  GET /replication/bootstrap
+  GET /replication/stream
+  GET /replication/status
+These serve replication to followers (see below). The status endpoint returns
+a msgpack object with keys "role" ("primary" or "follower") and "last", the
+latest local change log sequence number. A follower adds "primary",
+"applied" (the last of the primary's sequence numbers it has applied),
+"primary_last", "lag" (how many changes it is behind), "lag_seconds" (how long
+since it was last caught up), "connected", "bootstrapping" and "error".
+
+Run with "-follow http://primary:7000", ldbrest becomes a read-only replica of
+another ldbrest server. It first copies the primary's complete contents,
+replacing anything already in its own database, and then applies the primary's
+writes as they are committed, each batch all at once, reconnecting if it loses
+the primary. Writes from clients get a 403 ("Forbidden"), and expired keys are
+left for the primary to reap. A follower that falls further behind than the
+primary's change log goes back (see GET /changes) copies it all over again.
+
+While a follower is copying the primary its data is incomplete, so reads get a
+503 ("Service Unavailable") until it's done. The same goes for one restarted
+before its copy was done, even while it can't reach the primary. The copy
+isn't recorded in the follower's own change log, which is cut off before it,
+so anything following its changes has to start over as well.
 
 [1] https://github.com/google/leveldb
 */
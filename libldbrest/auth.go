@@ -0,0 +1,82 @@
+package libldbrest
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// AuthTokens are the bearer tokens that allow any request, and ReadTokens
+// those that only allow reads. With neither there is no authentication.
+var AuthTokens, ReadTokens []string
+
+// bearerToken pulls the token out of an "Authorization: Bearer" header
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(auth[7:])
+}
+
+func tokenIn(token string, tokens []string) bool {
+	var found bool
+	for _, t := range tokens {
+		// check them all, in constant time, so as not to leak them
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			found = true
+		}
+	}
+	return found
+}
+
+// authorized checks the request's token, and responds 401 or 403 itself if
+// it isn't good enough.
+func authorized(w http.ResponseWriter, r *http.Request, readOnly bool) bool {
+	if len(AuthTokens) == 0 && len(ReadTokens) == 0 {
+		return true
+	}
+
+	token := bearerToken(r)
+	switch {
+	case token == "":
+	case tokenIn(token, AuthTokens):
+		return true
+	case tokenIn(token, ReadTokens):
+		if readOnly {
+			return true
+		}
+		failCode(w, http.StatusForbidden)
+		return false
+	}
+
+	w.Header().Set("WWW-Authenticate", `Bearer realm="ldbrest"`)
+	failCode(w, http.StatusUnauthorized)
+	return false
+}
+
+// reads wraps a handler that only reads, which any token allows
+func reads(handle httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		if authorized(w, r, true) {
+			handle(w, r, p)
+		}
+	}
+}
+
+// admin wraps a handler that needs full access, but doesn't write any data
+func admin(handle httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		if authorized(w, r, false) {
+			handle(w, r, p)
+		}
+	}
+}
+
+// writes wraps a handler that writes data, which needs full access and
+// isn't allowed at all on a follower
+func (d *Database) writes(handle httprouter.Handle) httprouter.Handle {
+	return admin(d.writable(handle))
+}
@@ -1,32 +1,105 @@
 package libldbrest
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
 
 	"github.com/syndtr/goleveldb/leveldb"
 )
 
-type oplist []*struct {
-	Op    string `codec:"op"`
-	Key   string `codec:"key"`
-	Value string `codec:"value"`
+type oplist []*batchOp
+
+type batchOp struct {
+	Op        string `codec:"op"`
+	Key       string `codec:"key"`
+	Value     string `codec:"value"`
+	TTL       int64  `codec:"ttl,omitempty"`
+	ExpiresAt int64  `codec:"expires_at,omitempty"`
 }
 
 var errBadBatch = errors.New("bad write batch")
 
-func applyBatch(ops oplist) error {
-	batch := &leveldb.Batch{}
+// batchCheckError is what applyBatch returns when one of the batch's check
+// ops didn't hold against the current data, in which case nothing was written
+type batchCheckError struct {
+	Index  int    `codec:"index"`
+	Op     string `codec:"op"`
+	Key    string `codec:"key"`
+	Reason string `codec:"reason"`
+}
+
+func (bce *batchCheckError) Error() string {
+	return fmt.Sprintf("batch op %d (%s %q) failed: %s", bce.Index, bce.Op, bce.Key, bce.Reason)
+}
+
+func (d *Database) applyBatch(ops oplist) error {
+	checks := make([]int, 0)
+	for i, op := range ops {
+		switch op.Op {
+		case "put", "delete":
+		case "check_equals", "check_absent", "check_present":
+			checks = append(checks, i)
+		default:
+			return errBadBatch
+		}
+	}
+
+	// hold the lock from checking through writing so the checks still hold
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
 
+	for _, i := range checks {
+		if reason, err := d.checkOp(ops[i].Op, []byte(ops[i].Key), []byte(ops[i].Value)); err != nil {
+			return err
+		} else if reason != "" {
+			return &batchCheckError{i, ops[i].Op, ops[i].Key, reason}
+		}
+	}
+
+	t := d.newTxn()
 	for _, op := range ops {
+		var err error
 		switch op.Op {
 		case "put":
-			batch.Put([]byte(op.Key), []byte(op.Value))
+			var expires int64
+			if expires, err = expiresAt(op.TTL, op.ExpiresAt); err == nil {
+				err = t.put([]byte(op.Key), []byte(op.Value), expires)
+			}
 		case "delete":
-			batch.Delete([]byte(op.Key))
-		default:
+			err = t.del([]byte(op.Key))
+		}
+
+		if err == errBadExpiry || err == errReservedKey {
 			return errBadBatch
+		} else if err != nil {
+			return err
 		}
 	}
 
-	return db.Write(batch, nil)
+	return t.write()
+}
+
+// checkOp evaluates a single check op against the db, returning the reason
+// it failed or an empty string if it passed
+func (d *Database) checkOp(op string, key, value []byte) (string, error) {
+	current, err := get(d.db, key)
+	exists := true
+	if err == leveldb.ErrNotFound {
+		exists = false
+	} else if err != nil {
+		return "", err
+	}
+
+	switch {
+	case op == "check_absent" && exists:
+		return "key is present", nil
+	case op == "check_present" && !exists:
+		return "key is absent", nil
+	case op == "check_equals" && !exists:
+		return "key is absent", nil
+	case op == "check_equals" && !bytes.Equal(current, value):
+		return "value differs", nil
+	}
+	return "", nil
 }
@@ -0,0 +1,86 @@
+package libldbrest
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+var errPrecondition = errors.New("precondition failed")
+
+// etag produces the (quoted) entity tag for a value
+func etag(value []byte) string {
+	return fmt.Sprintf(`"%x"`, sha1.Sum(value))
+}
+
+// etagMatches checks an If-Match/If-None-Match style header against a key's
+// current value. Nothing matches a key that doesn't exist, and "*" matches
+// any key that does.
+func etagMatches(header string, exists bool, value []byte) bool {
+	if !exists {
+		return false
+	}
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+
+	tag := etag(value)
+	for _, t := range strings.Split(header, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(t), "W/") == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// preconditionsMet checks the request's If-Match and If-None-Match headers
+// against the key's current value.
+func (d *Database) preconditionsMet(r *http.Request, key []byte) (bool, error) {
+	ifMatch := r.Header.Get("If-Match")
+	ifNoneMatch := r.Header.Get("If-None-Match")
+	if ifMatch == "" && ifNoneMatch == "" {
+		return true, nil
+	}
+
+	exists := true
+	value, err := get(d.db, key)
+	if err == leveldb.ErrNotFound {
+		exists = false
+	} else if err != nil {
+		return false, err
+	}
+
+	if ifMatch != "" && !etagMatches(ifMatch, exists, value) {
+		return false, nil
+	}
+	if ifNoneMatch != "" && etagMatches(ifNoneMatch, exists, value) {
+		return false, nil
+	}
+	return true, nil
+}
+
+// conditionalWrite has write fill in a txn and writes it under the write
+// lock, but only if the key's current value satisfies the request's
+// preconditions (or there aren't any). Otherwise it returns errPrecondition.
+func (d *Database) conditionalWrite(r *http.Request, key []byte, write func(*txn) error) error {
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+
+	ok, err := d.preconditionsMet(r, key)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errPrecondition
+	}
+
+	t := d.newTxn()
+	if err := write(t); err != nil {
+		return err
+	}
+	return t.write()
+}
@@ -0,0 +1,228 @@
+package libldbrest
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"github.com/ugorji/go/codec"
+)
+
+var (
+	// ChangeLogMaxCount is how many of the most recent changes the change log
+	// retains (0 for no limit).
+	ChangeLogMaxCount = 100000
+
+	// ChangeLogMaxAge is how long the change log retains changes
+	// (0 for no limit).
+	ChangeLogMaxAge time.Duration
+)
+
+var errTruncated = errors.New("change log truncated past the requested sequence")
+
+/*
+The change log lives in the "changes" section of the reserved range, with each
+client-visible write stored under its sequence number (8 big-endian bytes) as
+a msgpack change. Entries are written in the same batch as the writes they
+record, so the log never disagrees with the data.
+
+Writes that skip the log use up a sequence number of their own instead, which
+is stored as "changelog/start" in the same batch. The log can't be read from
+any earlier than that, as it would be missing them, and the same goes for
+entries that have been pruned.
+*/
+
+func encodeSeq(seq uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, seq)
+	return b
+}
+
+func changeKey(seq uint64) []byte {
+	return metaKey("changes", encodeSeq(seq))
+}
+
+func logStartKey() []byte {
+	return metaKey("changelog", []byte("start"))
+}
+
+func changeSeq(key []byte) uint64 {
+	return binary.BigEndian.Uint64(key[len(key)-8:])
+}
+
+// logBroadcast's channel is closed (and replaced) whenever changes are added
+// to the log
+type logBroadcast struct {
+	sync.Mutex
+	ch chan struct{}
+}
+
+// logUpdates returns a channel that will be closed once more changes are logged
+func (d *Database) logUpdates() <-chan struct{} {
+	d.logUpdated.Lock()
+	defer d.logUpdated.Unlock()
+	return d.logUpdated.ch
+}
+
+func (d *Database) notifyLogUpdated() {
+	d.logUpdated.Lock()
+	defer d.logUpdated.Unlock()
+	close(d.logUpdated.ch)
+	d.logUpdated.ch = make(chan struct{})
+}
+
+// loadChangeLog picks the sequence back up where the freshly opened db left it
+func (d *Database) loadChangeLog() error {
+	var start uint64
+	b, err := d.db.Get(logStartKey(), nil)
+	if err == nil {
+		start = binary.BigEndian.Uint64(b)
+	} else if err != leveldb.ErrNotFound {
+		return err
+	}
+	atomic.StoreUint64(&d.logStart, start)
+
+	iter := d.db.NewIterator(util.BytesPrefix(metaKey("changes")), nil)
+	defer iter.Release()
+
+	seq := start
+	if iter.Last() && changeSeq(iter.Key()) > seq {
+		seq = changeSeq(iter.Key())
+	}
+	atomic.StoreUint64(&d.lastSeq, seq)
+	return iter.Error()
+}
+
+// breakChangeLog takes the next sequence number for a txn's unlogged writes,
+// and adds to its batch that the log now starts after it
+func (d *Database) breakChangeLog(t *txn) uint64 {
+	seq := atomic.LoadUint64(&d.lastSeq) + 1
+	t.batch.Put(logStartKey(), encodeSeq(seq))
+	return seq
+}
+
+// logChanges numbers a txn's changes and adds them to its batch, returning
+// what will be the last sequence number once the batch is written
+func (d *Database) logChanges(t *txn) uint64 {
+	seq := atomic.LoadUint64(&d.lastSeq)
+	last := seq + uint64(len(t.changes))
+	now := time.Now().Unix()
+
+	for _, c := range t.changes {
+		seq++
+		c.Seq = seq
+		c.Time = now
+		c.Txn = last
+
+		b := make([]byte, 0)
+		codec.NewEncoderBytes(&b, msgpack).Encode(c)
+		t.batch.Put(changeKey(seq), b)
+	}
+	return seq
+}
+
+// changesSince reads up to max changes with sequence numbers after since,
+// in order. It returns errTruncated if some of those have already been
+// pruned, along with the earliest sequence number still available.
+func (d *Database) changesSince(since uint64, max int) ([]*change, uint64, error) {
+	iter := d.db.NewIterator(util.BytesPrefix(metaKey("changes")), &opt.ReadOptions{
+		DontFillCache: true,
+	})
+	defer iter.Release()
+
+	if start := atomic.LoadUint64(&d.logStart); since < start {
+		return nil, start + 1, errTruncated
+	}
+	if !iter.First() {
+		// an empty log is only ok if nothing was ever pruned from it
+		if last := atomic.LoadUint64(&d.lastSeq); since < last {
+			return nil, last + 1, errTruncated
+		}
+		return []*change{}, 0, iter.Error()
+	}
+	if first := changeSeq(iter.Key()); first > since+1 {
+		return nil, first, errTruncated
+	}
+
+	changes := make([]*change, 0)
+	for iter.Seek(changeKey(since + 1)); iter.Valid() && len(changes) < max; iter.Next() {
+		c := &change{}
+		if err := codec.NewDecoderBytes(iter.Value(), msgpack).Decode(c); err != nil {
+			return nil, 0, err
+		}
+		changes = append(changes, c)
+	}
+	return changes, 0, iter.Error()
+}
+
+// pruneChanges deletes change log entries beyond ChangeLogMaxCount or older
+// than ChangeLogMaxAge, in batches, and returns how many it removed.
+func (d *Database) pruneChanges(now time.Time) (int, error) {
+	var total int
+	for {
+		n, err := d.pruneBatch(now)
+		total += n
+		if err != nil || n < deleteBatchSize {
+			return total, err
+		}
+	}
+}
+
+func (d *Database) pruneBatch(now time.Time) (int, error) {
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+
+	// anything from before the log's start is of no use any more
+	start := atomic.LoadUint64(&d.logStart)
+	keepFrom := start + 1
+	if last := atomic.LoadUint64(&d.lastSeq); ChangeLogMaxCount > 0 && last >= keepFrom+uint64(ChangeLogMaxCount) {
+		keepFrom = last - uint64(ChangeLogMaxCount) + 1
+	}
+
+	iter := d.db.NewIterator(util.BytesPrefix(metaKey("changes")), &opt.ReadOptions{
+		DontFillCache: true,
+	})
+	defer iter.Release()
+
+	t := d.newTxn()
+	var n int
+	for iter.First(); iter.Valid() && n < deleteBatchSize; iter.Next() {
+		if changeSeq(iter.Key()) >= keepFrom {
+			if ChangeLogMaxAge == 0 {
+				break
+			}
+
+			c := &change{}
+			if err := codec.NewDecoderBytes(iter.Value(), msgpack).Decode(c); err != nil {
+				return 0, err
+			}
+			if c.Time > now.Add(-ChangeLogMaxAge).Unix() {
+				break
+			}
+		}
+
+		if seq := changeSeq(iter.Key()); seq > start {
+			start = seq
+		}
+		t.batch.Delete(append([]byte{}, iter.Key()...))
+		n++
+	}
+	if err := iter.Error(); err != nil {
+		return 0, err
+	}
+
+	if n == 0 {
+		return 0, nil
+	}
+	t.batch.Put(logStartKey(), encodeSeq(start))
+	if err := t.write(); err != nil {
+		return 0, err
+	}
+	atomic.StoreUint64(&d.logStart, start)
+	return n, nil
+}
@@ -0,0 +1,405 @@
+package libldbrest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/journal"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+// how many times to try for a copy of the manifest that no compaction was
+// appending to at the time
+const checkpointRetries = 5
+
+var (
+	errCheckpointRaced = errors.New("db files changed underneath the checkpoint")
+	errBadManifest     = errors.New("unreadable db manifest")
+)
+
+/*
+A checkpoint is a copy of the db's own files rather than of its contents.
+
+Table files are never modified once written, so they can be hard-linked into
+the destination (or copied where it's on another filesystem). The journals
+and manifest are appended to, so those get copied while holding writeMu,
+which keeps the journals still. Compactions carry on in the background
+though, and would remove tables the copied manifest refers to, so for as long
+as a checkpoint is being taken the db's storage holds off removing any of its
+files. That way the tables can be linked or copied after letting go of
+writeMu, and the copy is consistent however long that takes. Only the tables
+the copied manifest refers to are taken, as others may be still being written
+by a compaction.
+*/
+
+// holdStorage wraps the db's storage so that checkpoints can hold off the
+// removal of its files
+type holdStorage struct {
+	storage.Storage
+
+	mu       sync.Mutex
+	holds    int
+	removals []storage.File
+}
+
+func (hs *holdStorage) wrap(f storage.File) storage.File {
+	if f == nil {
+		return nil
+	}
+	return &heldFile{f, hs}
+}
+
+func (hs *holdStorage) GetFile(num uint64, t storage.FileType) storage.File {
+	return hs.wrap(hs.Storage.GetFile(num, t))
+}
+
+func (hs *holdStorage) GetFiles(t storage.FileType) ([]storage.File, error) {
+	files, err := hs.Storage.GetFiles(t)
+	for i, f := range files {
+		files[i] = hs.wrap(f)
+	}
+	return files, err
+}
+
+func (hs *holdStorage) GetManifest() (storage.File, error) {
+	f, err := hs.Storage.GetManifest()
+	return hs.wrap(f), err
+}
+
+func (hs *holdStorage) SetManifest(f storage.File) error {
+	return hs.Storage.SetManifest(unwrapFile(f))
+}
+
+// hold defers the removal of any files until release
+func (hs *holdStorage) hold() {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	hs.holds++
+}
+
+// release lets go of a hold, removing whatever was held off once there are
+// none left
+func (hs *holdStorage) release() {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+
+	hs.holds--
+	if hs.holds > 0 {
+		return
+	}
+	for _, f := range hs.removals {
+		if err := f.Remove(); err != nil {
+			log.Printf("removing held off db file: %s", err)
+		}
+	}
+	hs.removals = nil
+}
+
+func (hs *holdStorage) remove(f storage.File) error {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+
+	if hs.holds > 0 {
+		hs.removals = append(hs.removals, f)
+		return nil
+	}
+	return f.Remove()
+}
+
+type heldFile struct {
+	storage.File
+	hs *holdStorage
+}
+
+func (hf *heldFile) Replace(newfile storage.File) error {
+	return hf.File.Replace(unwrapFile(newfile))
+}
+
+func (hf *heldFile) Remove() error {
+	return hf.hs.remove(hf.File)
+}
+
+// the underlying storage only accepts its own files
+func unwrapFile(f storage.File) storage.File {
+	if hf, ok := f.(*heldFile); ok {
+		return hf.File
+	}
+	return f
+}
+
+// dbFiles are the db's files as of a moment: contents of those still being
+// appended to, and the names of the immutable tables that go with them.
+// CURRENT is kept apart, as it belongs last in a copy.
+type dbFiles struct {
+	current []byte
+	copies  []*copiedFile
+	tables  []string
+}
+
+type copiedFile struct {
+	name string
+	data []byte
+}
+
+// captureFiles takes in the db's files for a checkpoint. The caller must have
+// a hold on the storage until done with the tables.
+func (d *Database) captureFiles() (*dbFiles, error) {
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+
+	files := &dbFiles{}
+	for i := 0; ; i++ {
+		if i == checkpointRetries {
+			return nil, errCheckpointRaced
+		}
+
+		current, err := ioutil.ReadFile(filepath.Join(d.path, "CURRENT"))
+		if err != nil {
+			return nil, err
+		}
+		manifest := strings.TrimSpace(string(current))
+		data, err := ioutil.ReadFile(filepath.Join(d.path, manifest))
+		if err != nil {
+			return nil, err
+		}
+
+		// was a compaction appending to it at the time?
+		now, err := ioutil.ReadFile(filepath.Join(d.path, "CURRENT"))
+		if err != nil {
+			return nil, err
+		}
+		fi, err := os.Stat(filepath.Join(d.path, manifest))
+		if err != nil {
+			return nil, err
+		}
+		if string(now) == string(current) && fi.Size() == int64(len(data)) {
+			files.current = current
+			files.copies = append(files.copies, &copiedFile{manifest, data})
+			break
+		}
+	}
+
+	tables, err := manifestTables(files.copies[0].data)
+	if err != nil {
+		return nil, err
+	}
+
+	infos, err := ioutil.ReadDir(d.path)
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range infos {
+		name := fi.Name()
+		switch ext := filepath.Ext(name); ext {
+		case ".ldb", ".sst":
+			num, err := strconv.ParseUint(strings.TrimSuffix(name, ext), 10, 64)
+			if err == nil && tables[num] {
+				files.tables = append(files.tables, name)
+			}
+		case ".log":
+			data, err := ioutil.ReadFile(filepath.Join(d.path, name))
+			if err != nil {
+				return nil, err
+			}
+			files.copies = append(files.copies, &copiedFile{name, data})
+		}
+	}
+	return files, nil
+}
+
+// the fields of a manifest record, as goleveldb writes them
+const (
+	manifestComparer       = 1
+	manifestJournalNum     = 2
+	manifestNextFileNum    = 3
+	manifestSeqNum         = 4
+	manifestCompactPointer = 5
+	manifestDeletedTable   = 6
+	manifestAddedTable     = 7
+	manifestPrevJournalNum = 9
+)
+
+// manifestTables replays a manifest's records to find the numbers of the
+// tables it ends up referring to
+func manifestTables(manifest []byte) (map[uint64]bool, error) {
+	tables := make(map[uint64]bool)
+	jr := journal.NewReader(bytes.NewReader(manifest), nil, true, true)
+	for {
+		r, err := jr.Next()
+		if err == io.EOF {
+			return tables, nil
+		} else if err != nil {
+			return nil, err
+		}
+		rec, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+
+		mr := &manifestRecord{b: rec}
+		for len(mr.b) > 0 && mr.err == nil {
+			switch mr.uvarint() {
+			case manifestComparer:
+				mr.skipBytes()
+			case manifestJournalNum, manifestNextFileNum, manifestSeqNum, manifestPrevJournalNum:
+				mr.uvarint()
+			case manifestCompactPointer:
+				mr.uvarint()
+				mr.skipBytes()
+			case manifestDeletedTable:
+				mr.uvarint()
+				delete(tables, mr.uvarint())
+			case manifestAddedTable:
+				mr.uvarint()
+				num := mr.uvarint()
+				mr.uvarint()
+				mr.skipBytes()
+				mr.skipBytes()
+				if mr.err == nil {
+					tables[num] = true
+				}
+			default:
+				mr.err = errBadManifest
+			}
+		}
+		if mr.err != nil {
+			return nil, mr.err
+		}
+	}
+}
+
+// manifestRecord reads the fields of a single manifest record
+type manifestRecord struct {
+	b   []byte
+	err error
+}
+
+func (mr *manifestRecord) uvarint() uint64 {
+	if mr.err != nil {
+		return 0
+	}
+	x, n := binary.Uvarint(mr.b)
+	if n <= 0 {
+		mr.err = errBadManifest
+		return 0
+	}
+	mr.b = mr.b[n:]
+	return x
+}
+
+func (mr *manifestRecord) skipBytes() {
+	n := mr.uvarint()
+	if mr.err == nil && n > uint64(len(mr.b)) {
+		mr.err = errBadManifest
+	}
+	if mr.err == nil {
+		mr.b = mr.b[n:]
+	}
+}
+
+// checkpoint makes a copy of the db at destpath, which mustn't exist yet, by
+// linking its files.
+func (d *Database) checkpoint(destpath string) error {
+	if err := os.Mkdir(destpath, 0755); err != nil {
+		return err
+	}
+
+	err := d.writeCheckpoint(destpath)
+	if err == nil {
+		// make sure it opens, which also checks that every table is there
+		var dest *leveldb.DB
+		if dest, err = leveldb.OpenFile(destpath, nil); err == nil {
+			err = dest.Close()
+		}
+	}
+	if err != nil {
+		os.RemoveAll(destpath)
+	}
+	return err
+}
+
+func (d *Database) writeCheckpoint(destpath string) error {
+	d.stor.hold()
+	defer d.stor.release()
+
+	files, err := d.captureFiles()
+	if err != nil {
+		return err
+	}
+
+	for _, cf := range files.copies {
+		if err := writeFile(filepath.Join(destpath, cf.name), cf.data); err != nil {
+			return err
+		}
+	}
+	for _, name := range files.tables {
+		if err := linkFile(filepath.Join(d.path, name), filepath.Join(destpath, name)); err != nil {
+			return err
+		}
+	}
+
+	// CURRENT goes in last, as it is what makes the directory a db
+	return writeFile(filepath.Join(destpath, "CURRENT"), files.current)
+}
+
+// linkFile hard-links src to dst, or falls back to copying it across
+// filesystems
+func linkFile(src, dst string) error {
+	err := os.Link(src, dst)
+	if le, ok := err.(*os.LinkError); ok && le.Err == syscall.EXDEV {
+		_, err = copyFile(src, dst)
+	}
+	return err
+}
+
+func copyFile(src, dst string) (int64, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return n, err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return n, err
+	}
+	return n, out.Close()
+}
+
+// writeFile is ioutil.WriteFile, but synced
+func writeFile(path string, data []byte) error {
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := out.Write(data); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
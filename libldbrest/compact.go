@@ -0,0 +1,108 @@
+package libldbrest
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+var errCompacting = errors.New("a compaction is already running")
+
+// compactState is the progress of the latest manual compaction
+type compactState struct {
+	Running  bool   `codec:"running"`
+	Start    string `codec:"start,omitempty"`
+	Limit    string `codec:"limit,omitempty"`
+	Started  int64  `codec:"started,omitempty"`
+	Finished int64  `codec:"finished,omitempty"`
+	Error    string `codec:"error,omitempty"`
+
+	// the bytes in the db's table files when it began, and now
+	SizeBefore int64 `codec:"size_before,omitempty"`
+	Size       int64 `codec:"size"`
+}
+
+// compactor tracks a database's manual compactions
+type compactor struct {
+	sync.Mutex
+	state compactState
+}
+
+// startCompaction compacts the range in the background, unless a compaction
+// is already running.
+func (d *Database) startCompaction(rng util.Range) (*compactState, error) {
+	size, err := d.tablesSize()
+	if err != nil {
+		return nil, err
+	}
+
+	d.compaction.Lock()
+	defer d.compaction.Unlock()
+
+	if d.compaction.state.Running {
+		st := d.compaction.state
+		return &st, errCompacting
+	}
+	d.compaction.state = compactState{
+		Running:    true,
+		Start:      string(rng.Start),
+		Limit:      string(rng.Limit),
+		Started:    time.Now().Unix(),
+		SizeBefore: size,
+		Size:       size,
+	}
+	st := d.compaction.state
+
+	go func() {
+		err := d.db.CompactRange(rng)
+		if err != nil {
+			log.Printf("compacting: %s", err)
+		}
+
+		d.compaction.Lock()
+		defer d.compaction.Unlock()
+		d.compaction.state.Running = false
+		d.compaction.state.Finished = time.Now().Unix()
+		if err != nil {
+			d.compaction.state.Error = err.Error()
+		}
+	}()
+
+	return &st, nil
+}
+
+// compactStatus reports on the latest compaction, with the db's current size
+func (d *Database) compactStatus() (*compactState, error) {
+	size, err := d.tablesSize()
+	if err != nil {
+		return nil, err
+	}
+
+	d.compaction.Lock()
+	defer d.compaction.Unlock()
+	st := d.compaction.state
+	st.Size = size
+	return &st, nil
+}
+
+// tablesSize adds up the sizes of the db's table files
+func (d *Database) tablesSize() (int64, error) {
+	files, err := ioutil.ReadDir(d.path)
+	if err != nil {
+		return 0, err
+	}
+
+	var size int64
+	for _, fi := range files {
+		switch filepath.Ext(fi.Name()) {
+		case ".ldb", ".sst":
+			size += fi.Size()
+		}
+	}
+	return size, nil
+}
@@ -0,0 +1,95 @@
+package libldbrest
+
+import (
+	"bytes"
+
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// the number of keys an approximate count reads to extrapolate from
+const countSample = 1000
+
+// bounds produces the util.Range covering the iteration in sorted order,
+// ignoring the finer points of which ends are inclusive.
+func (ir *iterRange) bounds() *util.Range {
+	lo, hi := []byte(ir.Start), []byte(ir.End)
+	if ir.Backwards {
+		lo, hi = hi, lo
+	}
+	if len(lo) == 0 {
+		lo = nil
+	}
+	if len(hi) == 0 {
+		hi = nil
+	}
+
+	if ir.Prefix != "" {
+		p := util.BytesPrefix([]byte(ir.Prefix))
+		if lo == nil || bytes.Compare(p.Start, lo) > 0 {
+			lo = p.Start
+		}
+		if p.Limit != nil && (hi == nil || bytes.Compare(p.Limit, hi) < 0) {
+			hi = p.Limit
+		}
+	}
+
+	return &util.Range{Start: lo, Limit: hi}
+}
+
+// countRange counts the keys in the range
+func (d *Database) countRange(src reader, ir *iterRange) (int, error) {
+	var n int
+	_, err := ir.iterate(src, maxInt, func(key, value []byte) error {
+		n++
+		return nil
+	})
+	return n, err
+}
+
+// approxCountRange estimates the keys in the range by reading just the first
+// countSample of them, then scaling up by how much of the range's on-disk
+// size those took. Where they aren't on disk yet there's nothing to scale by,
+// so it counts them all after all. It reports whether the result is in fact
+// exact, which is the case for small ranges.
+func (d *Database) approxCountRange(src reader, ir *iterRange) (int, bool, error) {
+	rng := ir.bounds()
+	iter := newUserIterator(src, rng, &opt.ReadOptions{
+		DontFillCache: true,
+	})
+	defer iter.Release()
+
+	var (
+		n     int
+		first []byte
+	)
+	for iter.First(); iter.Valid() && n < countSample; iter.Next() {
+		if n == 0 {
+			first = append([]byte{}, iter.Key()...)
+		}
+		n++
+	}
+	if !iter.Valid() {
+		n, err := d.countRange(src, ir)
+		return n, true, err
+	}
+	sampleEnd := append([]byte{}, iter.Key()...)
+
+	iter.Last()
+	// one past the last key, so that it falls within the measured range
+	last := append(append([]byte{}, iter.Key()...), 0)
+
+	sizes, err := userSizeOf(d.db, []util.Range{
+		{Start: first, Limit: sampleEnd},
+		{Start: first, Limit: last},
+	})
+	if err != nil {
+		return 0, false, err
+	}
+	if sizes[0] == 0 {
+		n, err := d.countRange(src, ir)
+		return n, true, err
+	}
+
+	return int(uint64(n) * sizes[1] / sizes[0]), false, nil
+}
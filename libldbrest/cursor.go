@@ -0,0 +1,84 @@
+package libldbrest
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/url"
+
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"github.com/ugorji/go/codec"
+)
+
+var errBadCursor = errors.New("bad iteration cursor")
+
+// iterRange describes the bounds and direction of an iteration.
+// It doubles as the contents of the opaque pagination cursors we hand out.
+type iterRange struct {
+	Start        string `codec:"s"`
+	End          string `codec:"e"`
+	Prefix       string `codec:"p"`
+	IncludeStart bool   `codec:"is"`
+	IncludeEnd   bool   `codec:"ie"`
+	Backwards    bool   `codec:"b"`
+}
+
+// rangeFromQuery pulls an iterRange out of /iterate-style query parameters,
+// or decodes it from the "cursor" parameter if one was provided.
+func rangeFromQuery(q url.Values) (*iterRange, error) {
+	if c := q.Get("cursor"); c != "" {
+		return decodeCursor(c)
+	}
+
+	// by default we traverse forwards and
+	// include "start" but not "end" (like go slicing)
+	return &iterRange{
+		Start:        q.Get("start"),
+		End:          q.Get("end"),
+		Prefix:       q.Get("prefix"),
+		IncludeStart: q.Get("include_start") != "no",
+		IncludeEnd:   q.Get("include_end") == "yes",
+		Backwards:    q.Get("forward") == "no",
+	}, nil
+}
+
+// iterate runs through the range, stopping after at most max keys, and
+// reports whether it was max that stopped it short.
+func (ir *iterRange) iterate(src reader, max int, handle func([]byte, []byte) error) (bool, error) {
+	// restrict the iterator to keys beginning with "prefix"
+	var slice *util.Range
+	if ir.Prefix != "" {
+		slice = util.BytesPrefix([]byte(ir.Prefix))
+	}
+
+	if ir.End == "" {
+		return iterateN(src, slice, []byte(ir.Start), max, ir.IncludeStart, ir.Backwards, handle)
+	}
+	return iterateUntil(src, slice, []byte(ir.Start), []byte(ir.End), max, ir.IncludeStart, ir.IncludeEnd, ir.Backwards, handle)
+}
+
+// cursor produces the token that resumes this iteration just past last,
+// or from where it began if nothing was handled yet (last is nil).
+func (ir *iterRange) cursor(last []byte) string {
+	next := *ir
+	if last != nil {
+		next.Start = string(last)
+		next.IncludeStart = false
+	}
+
+	b := make([]byte, 0)
+	codec.NewEncoderBytes(&b, msgpack).Encode(&next)
+	return base64.URLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(c string) (*iterRange, error) {
+	b, err := base64.URLEncoding.DecodeString(c)
+	if err != nil {
+		return nil, errBadCursor
+	}
+
+	ir := &iterRange{}
+	if err := codec.NewDecoderBytes(b, msgpack).Decode(ir); err != nil {
+		return nil, errBadCursor
+	}
+	return ir, nil
+}
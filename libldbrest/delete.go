@@ -0,0 +1,55 @@
+package libldbrest
+
+// how many deletes go into each write batch when clearing a range
+const deleteBatchSize = 1000
+
+// deleteRange removes every key in the range as of a point-in-time snapshot,
+// writing the deletes in batches, and returns how many keys it removed.
+// If unlogged, the deletes skip the change log (see txn.unlogged).
+func (d *Database) deleteRange(ir *iterRange, unlogged bool) (int, error) {
+	snap, err := d.db.GetSnapshot()
+	if err != nil {
+		return 0, err
+	}
+	defer snap.Release()
+
+	var (
+		keys = make([][]byte, 0, deleteBatchSize)
+		n    int
+	)
+
+	_, err = ir.iterate(snap, maxInt, func(key, value []byte) error {
+		keys = append(keys, append([]byte{}, key...))
+		if len(keys) == deleteBatchSize {
+			if err := d.deleteKeys(keys, unlogged); err != nil {
+				return err
+			}
+			n += len(keys)
+			keys = keys[:0]
+		}
+		return nil
+	})
+	if err != nil {
+		return n, err
+	}
+
+	if err := d.deleteKeys(keys, unlogged); err != nil {
+		return n, err
+	}
+	return n + len(keys), nil
+}
+
+// deleteKeys deletes a group of keys in a single write
+func (d *Database) deleteKeys(keys [][]byte, unlogged bool) error {
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+
+	t := d.newTxn()
+	t.unlogged = unlogged
+	for _, key := range keys {
+		if err := t.del(key); err != nil {
+			return err
+		}
+	}
+	return t.write()
+}
@@ -1,25 +1,43 @@
 package libldbrest
 
 import (
+	"io/ioutil"
+	"log"
 	"net/http"
 	"strconv"
+	"sync/atomic"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
 	"github.com/ugorji/go/codec"
 )
 
+// limits on how much a single request can ask for
+var (
+	// records in a page of results
+	ABSMAX = 1000
+	// keys in a page of bare keys, or ranges in a POST /sizes
+	KEYSMAX = 10000
+	// ops in a POST /batch or POST /incr
+	MaxBatchOps = 10000
+)
+
 const (
-	ABSMAX       = 1000
 	msgpackCType = "application/msgpack"
+	jsonCType    = "application/json"
+	cborCType    = "application/cbor"
+	bincCType    = "application/x-binc"
+	rawCType     = "application/octet-stream"
+	ndjsonCType  = "application/x-ndjson"
 )
 
 var msgpack = &codec.MsgpackHandle{}
 
-// InitRouter creates an *httprouter.Router and sets the endpoints to run the
-// ldbrest server
-func InitRouter(prefix string) *httprouter.Router {
-	router := &httprouter.Router{
+// NewRouter creates an *httprouter.Router for AddRoutes to add databases to
+func NewRouter() *httprouter.Router {
+	return &httprouter.Router{
 		// precision in urls -- I'd rather know when my client is wrong
 		RedirectTrailingSlash: false,
 		RedirectFixedPath:     false,
@@ -27,56 +45,174 @@ func InitRouter(prefix string) *httprouter.Router {
 		HandleMethodNotAllowed: true,
 		PanicHandler:           handlePanics,
 	}
+}
+
+// InitRouter creates an *httprouter.Router and sets the endpoints to run the
+// ldbrest server for the database from OpenDB
+func InitRouter(prefix string) *httprouter.Router {
+	router := NewRouter()
+	defaultDB.AddRoutes(router, prefix)
+	return router
+}
 
-	router.GET(prefix+"/key/*name", getItem)
-	router.POST(prefix+"/key", setItem)
-	router.DELETE(prefix+"/key/*name", deleteItem)
+// AddRoutes sets the endpoints for the database on router, under prefix
+func (d *Database) AddRoutes(router *httprouter.Router, prefix string) {
+	router.GET(prefix+"/key/*name", reads(d.loaded(d.getItem)))
+	router.POST(prefix+"/key", d.writes(d.setItem))
+	router.PUT(prefix+"/key/*name", d.writes(d.setRawItem))
+	router.DELETE(prefix+"/key/*name", d.writes(d.deleteItem))
+
+	router.POST(prefix+"/keys", reads(d.loaded(encoded(d.getItems))))
+	router.GET(prefix+"/iterate", reads(d.loaded(d.iterItems)))
+	router.GET(prefix+"/count", reads(d.loaded(encoded(d.countItems))))
+	router.POST(prefix+"/sizes", reads(d.loaded(encoded(d.getSizes))))
+	router.GET(prefix+"/export", reads(d.loaded(d.exportItems)))
+	router.DELETE(prefix+"/range", d.writes(encoded(d.deleteItems)))
+	router.POST(prefix+"/batch", d.writes(d.batchSetItems))
+	router.POST(prefix+"/incr/*name", d.writes(encoded(d.incrItem)))
+	router.POST(prefix+"/incr", d.writes(encoded(d.incrItems)))
+	router.POST(prefix+"/import", d.writes(encoded(d.importItems)))
+	router.GET(prefix+"/watch", reads(d.loaded(d.watchItems)))
+	router.GET(prefix+"/changes", reads(d.loaded(encoded(d.getChanges))))
+
+	router.GET(prefix+"/property/:name", reads(d.getLDBProperty))
+	router.GET(prefix+"/options", reads(encoded(d.getOptions)))
+	router.POST(prefix+"/compact", admin(encoded(d.compactItems)))
+	router.GET(prefix+"/compact", reads(encoded(d.getCompaction)))
+	router.POST(prefix+"/snapshot", admin(d.loaded(d.makeLDBSnapshot)))
+	router.GET(prefix+"/snapshot.tar", reads(d.loaded(d.getSnapshotTar)))
+
+	router.POST(prefix+"/snapshots", reads(d.loaded(encoded(d.createSnapshot))))
+	router.DELETE(prefix+"/snapshots/:id", reads(d.deleteSnapshot))
+
+	router.GET(prefix+"/replication/bootstrap", reads(d.loaded(d.replicationBootstrap)))
+	router.GET(prefix+"/replication/stream", reads(d.loaded(d.replicationStream)))
+	router.GET(prefix+"/replication/status", reads(encoded(d.replicationStatus)))
+}
 
-	router.POST(prefix+"/keys", getItems)
-	router.GET(prefix+"/iterate", iterItems)
-	router.POST(prefix+"/batch", batchSetItems)
+// pick what a read request reads from: the named snapshot from its "snapshot"
+// query parameter, or else the live db. It responds 410 itself if there's no
+// such snapshot (any more), and the returned func must be called when done.
+func (d *Database) readSource(w http.ResponseWriter, r *http.Request) (reader, func(), bool) {
+	id := r.URL.Query().Get("snapshot")
+	if id == "" {
+		return d.db, func() {}, true
+	}
 
-	router.GET(prefix+"/property/:name", getLDBProperty)
-	router.POST(prefix+"/snapshot", makeLDBSnapshot)
+	ls, ok := d.acquireSnapshot(id)
+	if !ok {
+		failCode(w, http.StatusGone)
+		return nil, nil, false
+	}
+	return ls, ls.done, true
+}
 
-	return router
+// readSnapshot is readSource for reads that need to see the db as of a single
+// moment all the way through. Without a named snapshot, they get a
+// point-in-time snapshot of their own.
+func (d *Database) readSnapshot(w http.ResponseWriter, r *http.Request) (reader, func(), bool) {
+	if r.URL.Query().Get("snapshot") != "" {
+		return d.readSource(w, r)
+	}
+
+	snap, err := d.db.GetSnapshot()
+	if err != nil {
+		failErr(w, err)
+		return nil, nil, false
+	}
+	return snap, snap.Release, true
 }
 
 // retrieve single keys
-func getItem(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+func (d *Database) getItem(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	src, done, ok := d.readSource(w, r)
+	if !ok {
+		return
+	}
+	defer done()
+
 	key := p.ByName("name")[1:]
-	val, err := db.Get([]byte(key), nil)
+	val, err := get(src, []byte(key))
 	if err == leveldb.ErrNotFound {
 		failCode(w, http.StatusNotFound)
 	} else if err != nil {
 		failErr(w, err)
+	} else if wantsRaw(r) {
+		w.Header().Set("ETag", etag(val))
+		w.Header().Set("Content-Type", rawCType)
+		w.Write(val)
 	} else {
-		w.Header().Set("Content-Type", msgpackCType)
-		codec.NewEncoder(w, msgpack).Encode(keyval{key, string(val)})
+		w.Header().Set("ETag", etag(val))
+		encodeResponse(w, r, keyval{key, string(val)})
+	}
+}
+
+// set single key (key/value struct in body, with optional expiry)
+func (d *Database) setItem(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	req := &struct {
+		Key       string `codec:"key"`
+		Value     string `codec:"value"`
+		TTL       int64  `codec:"ttl"`
+		ExpiresAt int64  `codec:"expires_at"`
+	}{}
+	if !decodeRequest(w, r, req) {
+		return
 	}
+
+	expires, err := expiresAt(req.TTL, req.ExpiresAt)
+	if err != nil {
+		failCode(w, http.StatusBadRequest)
+		return
+	}
+
+	d.putItem(w, r, []byte(req.Key), []byte(req.Value), expires)
 }
 
-// set single key (key/value msgpack struct in body)
-func setItem(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	kv := &keyval{}
-	err := codec.NewDecoder(r.Body, msgpack).Decode(kv)
+// set single key (name in the url, request body stored verbatim as the value)
+func (d *Database) setRawItem(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	expires, err := expiryFromQuery(r.URL.Query())
 	if err != nil {
-		failErr(w, err)
+		failCode(w, http.StatusBadRequest)
 		return
 	}
 
-	err = db.Put([]byte(kv.Key), []byte(kv.Value), nil)
+	val, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		failErr(w, err)
+		return
+	}
+
+	d.putItem(w, r, []byte(p.ByName("name")[1:]), val, expires)
+}
+
+// write a single key, subject to any If-Match/If-None-Match headers
+func (d *Database) putItem(w http.ResponseWriter, r *http.Request, key, val []byte, expires int64) {
+	err := d.conditionalWrite(r, key, func(t *txn) error {
+		return t.put(key, val, expires)
+	})
+	if err == errPrecondition {
+		failCode(w, http.StatusPreconditionFailed)
+	} else if err == errReservedKey {
+		failCode(w, http.StatusBadRequest)
+	} else if err != nil {
+		failErr(w, err)
 	} else {
+		w.Header().Set("ETag", etag(val))
 		w.WriteHeader(http.StatusNoContent)
 	}
 }
 
 // delete a key by name
-func deleteItem(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-	err := db.Delete([]byte(p.ByName("name")[1:]), nil)
-	if err != nil {
+func (d *Database) deleteItem(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	key := []byte(p.ByName("name")[1:])
+	err := d.conditionalWrite(r, key, func(t *txn) error {
+		return t.del(key)
+	})
+	if err == errPrecondition {
+		failCode(w, http.StatusPreconditionFailed)
+	} else if err == errReservedKey {
+		failCode(w, http.StatusBadRequest)
+	} else if err != nil {
 		failErr(w, err)
 	} else {
 		w.WriteHeader(http.StatusNoContent)
@@ -85,20 +221,30 @@ func deleteItem(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 
 // retrieve a given set of keys
 // (must be a POST to accept a request body, but we aren't changing server-side data)
-func getItems(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+func (d *Database) getItems(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	req := &struct {
 		Keys []string `codec:"keys"`
 	}{}
 
-	err := codec.NewDecoder(r.Body, msgpack).Decode(req)
+	fields, err := fieldsFromQuery(r.URL.Query())
 	if err != nil {
-		failErr(w, err)
+		failCode(w, http.StatusBadRequest)
+		return
+	}
+
+	if !decodeRequest(w, r, req) {
+		return
+	}
+
+	src, done, ok := d.readSource(w, r)
+	if !ok {
 		return
 	}
+	defer done()
 
 	results := make([]*keyval, 0, len(req.Keys))
 	for _, key := range req.Keys {
-		val, err := db.Get([]byte(key), nil)
+		val, err := get(src, []byte(key))
 		if err == leveldb.ErrNotFound {
 			continue
 		} else if err != nil {
@@ -109,83 +255,233 @@ func getItems(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 		}
 	}
 
-	w.Header().Set("Content-Type", msgpackCType)
-	codec.NewEncoder(w, msgpack).Encode(multiResponse{nil, results})
+	encodeResponse(w, r, fields.response(&multiResponse{Data: results}))
 }
 
 // fetch a contiguous range of keys and their values
-func iterItems(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+func (d *Database) iterItems(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	q := r.URL.Query()
-	start := q.Get("start")
-	end := q.Get("end")
 
-	var (
-		max int
-		err error
-	)
-	maxs := q.Get("max")
-	if maxs == "" {
-		max = ABSMAX
-	} else if max, err = strconv.Atoi(maxs); err != nil {
-		failErr(w, err)
+	ir, err := rangeFromQuery(q)
+	if err != nil {
+		failCode(w, http.StatusBadRequest)
+		return
+	}
+
+	fields, err := fieldsFromQuery(q)
+	if err != nil {
+		failCode(w, http.StatusBadRequest)
 		return
 	}
-	if max > ABSMAX {
-		max = ABSMAX
+
+	// streamed responses aren't held in memory, so they aren't capped,
+	// and pages of bare keys are small enough to allow more of them
+	stream := q.Get("stream") == "yes"
+	limit := ABSMAX
+	if stream {
+		limit = maxInt
+	} else if fields == keysOnly {
+		limit = KEYSMAX
+	}
+
+	max := limit
+	if maxs := q.Get("max"); maxs != "" {
+		if max, err = strconv.Atoi(maxs); err != nil {
+			failErr(w, err)
+			return
+		}
+		if max > limit {
+			max = limit
+		}
+	}
+
+	src, done, ok := d.readSource(w, r)
+	if !ok {
+		return
 	}
+	defer done()
 
-	// by default we traverse forwards and
-	// include "start" but not "end" (like go slicing)
-	ignore_start := q.Get("include_start") == "no"
-	include_end := q.Get("include_end") == "yes"
-	backwards := q.Get("forward") == "no"
+	if stream {
+		streamItems(w, r, src, ir, max, fields)
+		return
+	}
 
 	var (
 		data = make([]*keyval, 0)
 		more bool
 	)
 
-	var once func([]byte, []byte) error
+	var (
+		last []byte
+		once func([]byte, []byte) error
+	)
 	once = func(key, value []byte) error {
 		data = append(data, &keyval{string(key), string(value)})
+		last = append(last[:0], key...)
 		return nil
 	}
 
-	if end == "" {
-		err = iterateN([]byte(start), max, !ignore_start, backwards, once)
-		more = false
+	more, err = ir.iterate(src, max, once)
+	if err != nil {
+		failErr(w, err)
+		return
+	}
+
+	resp := &multiResponse{More: &more, Data: data}
+	if more {
+		resp.Cursor = ir.cursor(last)
+	}
+	encodeResponse(w, r, fields.response(resp))
+}
+
+// stream the keys in a range in the portable export format
+func (d *Database) exportItems(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	ir, err := rangeFromQuery(r.URL.Query())
+	if err != nil {
+		failCode(w, http.StatusBadRequest)
+		return
+	}
+
+	src, done, ok := d.readSnapshot(w, r)
+	if !ok {
+		return
+	}
+	defer done()
+
+	d.streamExport(w, r, src, ir)
+}
+
+// count the keys in a contiguous range
+func (d *Database) countItems(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	q := r.URL.Query()
+
+	ir, err := rangeFromQuery(q)
+	if err != nil {
+		failCode(w, http.StatusBadRequest)
+		return
+	}
+
+	src, done, ok := d.readSnapshot(w, r)
+	if !ok {
+		return
+	}
+	defer done()
+
+	resp := &struct {
+		Count       int  `codec:"count"`
+		Approximate bool `codec:"approximate"`
+	}{}
+
+	if q.Get("approximate") == "yes" {
+		var exact bool
+		resp.Count, exact, err = d.approxCountRange(src, ir)
+		resp.Approximate = !exact
 	} else {
-		more, err = iterateUntil([]byte(start), []byte(end), max, !ignore_start, include_end, backwards, once)
+		resp.Count, err = d.countRange(src, ir)
 	}
 
 	if err != nil {
 		failErr(w, err)
 		return
 	}
-	w.Header().Set("Content-Type", msgpackCType)
-	codec.NewEncoder(w, msgpack).Encode(&multiResponse{&more, data})
+	encodeResponse(w, r, resp)
+}
+
+// estimate the on-disk size of ranges, or of the biggest groups of keys
+func (d *Database) getSizes(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	req := &struct {
+		Ranges    []*sizeRange `codec:"ranges"`
+		Delimiter string       `codec:"delimiter"`
+		Prefix    string       `codec:"prefix"`
+		Top       int          `codec:"top"`
+	}{Top: 10}
+
+	if !decodeRequest(w, r, req) {
+		return
+	}
+
+	var err error
+	if req.Delimiter != "" {
+		if req.Ranges != nil || req.Top > ABSMAX {
+			failCode(w, http.StatusBadRequest)
+			return
+		}
+		req.Ranges, err = d.topPrefixes([]byte(req.Prefix), []byte(req.Delimiter), req.Top)
+	} else {
+		if len(req.Ranges) > KEYSMAX {
+			failCode(w, http.StatusRequestEntityTooLarge)
+			return
+		}
+		err = d.rangeSizes(req.Ranges)
+	}
+
+	if err == errBadSizes {
+		failCode(w, http.StatusBadRequest)
+		return
+	} else if err != nil {
+		failErr(w, err)
+		return
+	}
+
+	encodeResponse(w, r, &struct {
+		Data []*sizeRange `codec:"data"`
+	}{req.Ranges})
+}
+
+// delete every key in a contiguous range
+func (d *Database) deleteItems(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	q := r.URL.Query()
+
+	ir, err := rangeFromQuery(q)
+	if err != nil {
+		failCode(w, http.StatusBadRequest)
+		return
+	}
+
+	// refuse to wipe the whole database over a missing query string
+	if ir.Start == "" && ir.End == "" && ir.Prefix == "" {
+		failCode(w, http.StatusBadRequest)
+		return
+	}
+
+	n, err := d.deleteRange(ir, q.Get("log") == "no")
+	if err != nil {
+		failErr(w, err)
+		return
+	}
+
+	if q.Get("compact") == "yes" {
+		if err := d.db.CompactRange(*ir.bounds()); err != nil {
+			failErr(w, err)
+			return
+		}
+	}
+
+	encodeResponse(w, r, &struct {
+		Deleted int `codec:"deleted"`
+	}{n})
 }
 
 // atomically write a batch of updates
-func batchSetItems(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+func (d *Database) batchSetItems(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	req := &struct {
 		Ops oplist `codec:"ops"`
 	}{}
 
-	err := codec.NewDecoder(r.Body, msgpack).Decode(req)
-	if err != nil {
-		failErr(w, err)
+	if !decodeRequest(w, r, req) {
 		return
 	}
 
-	if len(req.Ops) > 10000 {
+	if len(req.Ops) > MaxBatchOps {
 		failCode(w, http.StatusRequestEntityTooLarge)
 		return
 	}
 
-	err = applyBatch(req.Ops)
+	err := d.applyBatch(req.Ops)
 	if err == errBadBatch {
 		failCode(w, http.StatusBadRequest)
+	} else if bce, ok := err.(*batchCheckError); ok {
+		encodeStatus(w, r, http.StatusConflict, bce)
 	} else if err != nil {
 		failErr(w, err)
 	} else {
@@ -193,10 +489,177 @@ func batchSetItems(w http.ResponseWriter, r *http.Request, p httprouter.Params)
 	}
 }
 
+// load a stream of key/value records in bounded batches
+func (d *Database) importItems(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	mode, err := importModeFromQuery(r.URL.Query())
+	if err != nil {
+		failCode(w, http.StatusBadRequest)
+		return
+	}
+
+	h, ok := streamRequestHandle(r)
+	if !ok {
+		failCode(w, http.StatusUnsupportedMediaType)
+		return
+	}
+
+	unlogged := r.URL.Query().Get("log") == "no"
+	res, err := d.importRecords(codec.NewDecoder(r.Body, h), mode, unlogged)
+	if ie, ok := err.(*importError); ok {
+		res.Offset = &ie.Offset
+		res.Error = ie.Err.Error()
+		code := http.StatusBadRequest
+		if ie.Err == errKeyExists {
+			code = http.StatusConflict
+		}
+		encodeStatus(w, r, code, res)
+	} else if err != nil {
+		failErr(w, err)
+	} else {
+		encodeResponse(w, r, res)
+	}
+}
+
+// atomically add to an integer value (delta in the query string, default 1)
+func (d *Database) incrItem(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	delta := int64(1)
+	if ds := r.URL.Query().Get("delta"); ds != "" {
+		var err error
+		if delta, err = strconv.ParseInt(ds, 10, 64); err != nil {
+			failCode(w, http.StatusBadRequest)
+			return
+		}
+	}
+
+	results, err := d.incrKeys([]*counter{{p.ByName("name")[1:], delta}})
+	if nce, ok := err.(*notCounterError); ok {
+		encodeStatus(w, r, http.StatusConflict, nce)
+	} else if coe, ok := err.(*counterOverflowError); ok {
+		encodeStatus(w, r, http.StatusConflict, coe)
+	} else if err == errReservedKey {
+		failCode(w, http.StatusBadRequest)
+	} else if err != nil {
+		failErr(w, err)
+	} else {
+		encodeResponse(w, r, results[0])
+	}
+}
+
+// atomically add to a group of integer values
+func (d *Database) incrItems(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	req := &struct {
+		Incrs []*counter `codec:"incrs"`
+	}{}
+
+	if !decodeRequest(w, r, req) {
+		return
+	}
+
+	if len(req.Incrs) > MaxBatchOps {
+		failCode(w, http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	results, err := d.incrKeys(req.Incrs)
+	if nce, ok := err.(*notCounterError); ok {
+		encodeStatus(w, r, http.StatusConflict, nce)
+	} else if coe, ok := err.(*counterOverflowError); ok {
+		encodeStatus(w, r, http.StatusConflict, coe)
+	} else if err == errReservedKey {
+		failCode(w, http.StatusBadRequest)
+	} else if err != nil {
+		failErr(w, err)
+	} else {
+		encodeResponse(w, r, &struct {
+			Data []*counter `codec:"data"`
+		}{results})
+	}
+}
+
+// stream changes to keys under a prefix as server-sent events
+func (d *Database) watchItems(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	q := r.URL.Query()
+
+	wt := d.addWatcher(q.Get("prefix"))
+	defer d.removeWatcher(wt)
+
+	streamChanges(w, wt, q.Get("values") == "yes")
+}
+
+// read the change log after a given sequence number
+func (d *Database) getChanges(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	q := r.URL.Query()
+
+	var since uint64
+	if ss := q.Get("since"); ss != "" {
+		var err error
+		if since, err = strconv.ParseUint(ss, 10, 64); err != nil {
+			failCode(w, http.StatusBadRequest)
+			return
+		}
+	}
+
+	max := ABSMAX
+	if maxs := q.Get("max"); maxs != "" {
+		var err error
+		if max, err = strconv.Atoi(maxs); err != nil {
+			failErr(w, err)
+			return
+		}
+		if max > ABSMAX {
+			max = ABSMAX
+		}
+	}
+
+	changes, first, err := d.changesSince(since, max)
+	if err == errTruncated {
+		encodeStatus(w, r, http.StatusGone, &struct {
+			Error string `codec:"error"`
+			First uint64 `codec:"first"`
+		}{err.Error(), first})
+		return
+	} else if err != nil {
+		failErr(w, err)
+		return
+	}
+
+	// a write can land in the log a moment before lastSeq catches up with it
+	last := atomic.LoadUint64(&d.lastSeq)
+	if n := len(changes); n > 0 && changes[n-1].Seq > last {
+		last = changes[n-1].Seq
+	}
+
+	encodeResponse(w, r, &struct {
+		Changes []*change `codec:"changes"`
+		Last    uint64    `codec:"last"`
+	}{changes, last})
+}
+
+// stream a complete copy of the db for a follower to start from
+func (d *Database) replicationBootstrap(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	d.streamBootstrap(w)
+}
+
+// stream committed changes after a given sequence number to a follower
+func (d *Database) replicationStream(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	since, err := strconv.ParseUint(r.URL.Query().Get("since"), 10, 64)
+	if err != nil {
+		failCode(w, http.StatusBadRequest)
+		return
+	}
+	d.streamReplication(w, r, since)
+}
+
+// report which side of replication we're on and, for a follower, how far
+// behind the primary it is
+func (d *Database) replicationStatus(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	encodeResponse(w, r, d.followStatus())
+}
+
 // get a leveldb property
-func getLDBProperty(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+func (d *Database) getLDBProperty(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	name := p.ByName("name")
-	prop, err := db.GetProperty(name)
+	prop, err := d.db.GetProperty(name)
 	if err == leveldb.ErrNotFound {
 		failCode(w, http.StatusNotFound)
 	} else if err != nil {
@@ -207,21 +670,122 @@ func getLDBProperty(w http.ResponseWriter, r *http.Request, p httprouter.Params)
 	}
 }
 
-// copy the whole db via a point-in-time snapshot
-func makeLDBSnapshot(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+// copy the whole db to a path on the server
+func (d *Database) makeLDBSnapshot(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	req := &struct {
 		Destination string `codec:"destination"`
+		Mode        string `codec:"mode"`
 	}{}
-	err := codec.NewDecoder(r.Body, msgpack).Decode(req)
+	if !decodeRequest(w, r, req) {
+		return
+	}
+
+	err := d.makeSnap(req.Destination, req.Mode)
+	if err == errBadSnapMode {
+		failCode(w, http.StatusBadRequest)
+	} else if err != nil {
+		failErr(w, err)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// report the leveldb options the db was opened with, defaults and all
+func (d *Database) getOptions(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	encodeResponse(w, r, d.options.effective())
+}
+
+// compact a range (or everything) in the background
+func (d *Database) compactItems(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	ir, err := rangeFromQuery(r.URL.Query())
+	if err != nil {
+		failCode(w, http.StatusBadRequest)
+		return
+	}
+
+	// with no bounds, include ldbrest's own data too
+	rng := util.Range{}
+	if ir.Start != "" || ir.End != "" || ir.Prefix != "" {
+		rng = *ir.bounds()
+	}
+
+	st, err := d.startCompaction(rng)
+	if err == errCompacting {
+		encodeStatus(w, r, http.StatusConflict, st)
+	} else if err != nil {
+		failErr(w, err)
+	} else {
+		encodeStatus(w, r, http.StatusAccepted, st)
+	}
+}
+
+// report on the latest compaction from POST /compact
+func (d *Database) getCompaction(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	st, err := d.compactStatus()
 	if err != nil {
 		failErr(w, err)
 		return
 	}
+	encodeResponse(w, r, st)
+}
+
+// download a copy of the whole db as a tar archive
+func (d *Database) getSnapshotTar(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	d.stor.hold()
+	defer d.stor.release()
 
-	if err := makeSnap(req.Destination); err != nil {
+	files, err := d.captureFiles()
+	if err != nil {
 		failErr(w, err)
+		return
+	}
+
+	gz := r.URL.Query().Get("gzip") == "yes"
+	if gz {
+		w.Header().Set("Content-Type", "application/gzip")
 	} else {
+		w.Header().Set("Content-Type", "application/x-tar")
+	}
+
+	// too late to change the response code, so all we can do is log
+	if err := d.writeTar(w, files, gz); err != nil {
+		log.Printf("sending snapshot tarball stopped: %s", err)
+	}
+}
+
+// create a named snapshot for later reads (lease in seconds in the query string)
+func (d *Database) createSnapshot(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	lease := DefaultSnapshotLease
+	if ls := r.URL.Query().Get("lease"); ls != "" {
+		secs, err := strconv.Atoi(ls)
+		if err != nil || secs <= 0 {
+			failCode(w, http.StatusBadRequest)
+			return
+		}
+		lease = time.Duration(secs) * time.Second
+	}
+	if lease > MaxSnapshotLease {
+		lease = MaxSnapshotLease
+	}
+
+	ls, err := d.newSnapshot(lease)
+	if err != nil {
+		failErr(w, err)
+		return
+	}
+
+	encodeResponse(w, r, &struct {
+		ID    string `codec:"id"`
+		Lease int    `codec:"lease"`
+	}{ls.id, int(lease / time.Second)})
+}
+
+// release a named snapshot
+func (d *Database) deleteSnapshot(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	if d.expireSnapshot(p.ByName("id")) {
 		w.WriteHeader(http.StatusNoContent)
+	} else {
+		failCode(w, http.StatusNotFound)
 	}
 }
 
@@ -231,6 +795,7 @@ type keyval struct {
 }
 
 type multiResponse struct {
-	More *bool     `codec:"more,omitempty"`
-	Data []*keyval `codec:"data"`
+	More   *bool     `codec:"more,omitempty"`
+	Cursor string    `codec:"cursor,omitempty"`
+	Data   []*keyval `codec:"data"`
 }
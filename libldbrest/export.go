@@ -0,0 +1,140 @@
+package libldbrest
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/ugorji/go/codec"
+)
+
+/*
+An export is a stream of records (in msgpack, or any of the other formats)
+made up of:
+
+  - a header, with keys "format" (always "ldbrest-export"), "version" and
+    "created" (a unix timestamp)
+  - a record for each key, with keys "key", "value", "expires_at" (if it
+    expires) and "crc", a checksum of the rest
+  - a trailer, with key "count", the number of key records
+
+POST /import recognizes an export by its header, and checks the checksums
+and the trailer.
+*/
+
+const (
+	exportFormat  = "ldbrest-export"
+	exportVersion = 1
+)
+
+var (
+	errBadExport      = errors.New("malformed export")
+	errExportVersion  = errors.New("unsupported export version")
+	errExportChecksum = errors.New("export record checksum mismatch")
+	errExportCount    = errors.New("export trailer count mismatch")
+	errExportTrunc    = errors.New("export is missing its trailer")
+)
+
+type exportHeader struct {
+	Format  string `codec:"format"`
+	Version int    `codec:"version"`
+	Created int64  `codec:"created"`
+}
+
+type exportTrailer struct {
+	Count int `codec:"count"`
+}
+
+// recordChecksum is the CRC-32 (IEEE) of the key's length as a big-endian
+// uint32, the key, the value, and the expiry as a big-endian int64.
+func recordChecksum(key, value string, expires int64) uint32 {
+	h := crc32.NewIEEE()
+	binary.Write(h, binary.BigEndian, uint32(len(key)))
+	io.WriteString(h, key)
+	io.WriteString(h, value)
+	binary.Write(h, binary.BigEndian, expires)
+	return h.Sum32()
+}
+
+// streamExport writes the range out as an export. src should be a snapshot,
+// so that the export is of a single moment.
+func (d *Database) streamExport(w http.ResponseWriter, r *http.Request, src reader, ir *iterRange) {
+	ct, h, ok := streamHandle(r)
+	if !ok {
+		failCode(w, http.StatusNotAcceptable)
+		return
+	}
+
+	var gone <-chan bool
+	if cn, ok := w.(http.CloseNotifier); ok {
+		gone = cn.CloseNotify()
+	}
+	flusher, _ := w.(http.Flusher)
+
+	w.Header().Set("Content-Type", ct)
+	enc := codec.NewEncoder(w, h)
+	write := func(v interface{}) error {
+		if err := enc.Encode(v); err != nil {
+			return err
+		}
+		if ct == ndjsonCType {
+			_, err := w.Write([]byte("\n"))
+			return err
+		}
+		return nil
+	}
+
+	err := write(&exportHeader{exportFormat, exportVersion, time.Now().Unix()})
+
+	expiries := newExpiryCursor(src, ir.Backwards)
+	defer expiries.release()
+
+	var count int
+	if err == nil {
+		_, err = ir.iterate(src, maxInt, func(key, value []byte) error {
+			select {
+			case <-gone:
+				return errClientGone
+			default:
+			}
+
+			expires, err := expiries.expiry(key)
+			if err != nil {
+				return err
+			}
+			crc := recordChecksum(string(key), string(value), expires)
+			err = write(&importRecord{
+				Key:       string(key),
+				Value:     string(value),
+				ExpiresAt: expires,
+				CRC:       &crc,
+			})
+			if err != nil {
+				return err
+			}
+
+			count++
+			if flusher != nil && count%streamFlushEvery == 0 {
+				flusher.Flush()
+			}
+			return nil
+		})
+	}
+	if err == nil {
+		err = write(&exportTrailer{count})
+	}
+
+	// too late to change the response code, so all we can do is log, and
+	// leave out the trailer so that the export can't be mistaken for whole
+	if err != nil {
+		log.Printf("export stopped: %s", err)
+		return
+	}
+	if flusher != nil {
+		flusher.Flush()
+	}
+}
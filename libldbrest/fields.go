@@ -0,0 +1,71 @@
+package libldbrest
+
+import (
+	"errors"
+	"net/url"
+)
+
+// fieldSet selects which halves of each key/value pair make it into a response
+type fieldSet int
+
+const (
+	bothFields fieldSet = iota
+	keysOnly
+	valuesOnly
+)
+
+var errBadFields = errors.New("bad fields selection")
+
+func fieldsFromQuery(q url.Values) (fieldSet, error) {
+	switch q.Get("fields") {
+	case "", "both":
+		return bothFields, nil
+	case "keys":
+		return keysOnly, nil
+	case "values":
+		return valuesOnly, nil
+	default:
+		return bothFields, errBadFields
+	}
+}
+
+// record builds the response object for a single key/value pair,
+// leaving out whichever half wasn't asked for.
+func (fs fieldSet) record(key, value string) interface{} {
+	switch fs {
+	case keysOnly:
+		return &keyonly{key}
+	case valuesOnly:
+		return &valueonly{value}
+	default:
+		return &keyval{key, value}
+	}
+}
+
+// response is what to encode for a page of results: the page itself when
+// both halves were asked for, or a copy holding just the one.
+func (fs fieldSet) response(mr *multiResponse) interface{} {
+	if fs == bothFields {
+		return mr
+	}
+	data := make([]interface{}, len(mr.Data))
+	for i, kv := range mr.Data {
+		data[i] = fs.record(kv.Key, kv.Value)
+	}
+	return &partialResponse{mr.More, mr.Cursor, data}
+}
+
+// partialResponse is a multiResponse with part of each key/value pair
+type partialResponse struct {
+	More   *bool         `codec:"more,omitempty"`
+	Cursor string        `codec:"cursor,omitempty"`
+	Data   []interface{} `codec:"data"`
+}
+
+type keyonly struct {
+	Key string `codec:"key"`
+}
+
+type valueonly struct {
+	Value string `codec:"value"`
+}
@@ -0,0 +1,442 @@
+package libldbrest
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/ugorji/go/codec"
+)
+
+// FollowToken is the bearer token a follower sends to its primary, if any.
+var FollowToken string
+
+// FollowRetryInterval is how long a follower waits to reconnect to its
+// primary after losing the replication stream.
+var FollowRetryInterval = time.Second
+
+var (
+	errNeedBootstrap = errors.New("primary's change log was truncated past what we've applied")
+	errBadStream     = errors.New("unexpected record in replication stream")
+)
+
+func (d *Database) isFollowing() bool {
+	return atomic.LoadInt32(&d.follower.following) != 0
+}
+
+// followerState is a follower's view of its replication, for the status
+// endpoint
+type followerState struct {
+	sync.Mutex
+
+	// following is nonzero while the database is a read-only follower, and
+	// bootstrapping while its data is incomplete
+	following, bootstrapping int32
+
+	primary     string
+	applied     uint64
+	primaryLast uint64
+	caughtUp    time.Time
+	connected   bool
+	err         error
+
+	// the response body currently being read, closed to interrupt it
+	body       io.Closer
+	stop, done chan struct{}
+}
+
+// Follow turns the database into a read-only follower of the ldbrest primary
+// at the given base URL. It bootstraps from a copy of the primary's data (if
+// it hasn't already) and then applies the primary's writes as they happen,
+// reconnecting whenever the stream is lost.
+func (d *Database) Follow(primary string) {
+	primary = strings.TrimRight(primary, "/")
+	atomic.StoreInt32(&d.follower.following, 1)
+
+	// without a finished bootstrap the data may be a partial copy, which is
+	// no more complete for the primary being out of reach
+	if _, ok, _ := d.loadApplied(); !ok {
+		atomic.StoreInt32(&d.follower.bootstrapping, 1)
+	}
+
+	d.follower.Lock()
+	d.follower.primary = primary
+	d.follower.stop = make(chan struct{})
+	d.follower.done = make(chan struct{})
+	stop, done := d.follower.stop, d.follower.done
+	d.follower.Unlock()
+
+	go func() {
+		defer close(done)
+		for {
+			err := d.followOnce(primary)
+
+			d.follower.Lock()
+			d.follower.connected = false
+			d.follower.err = err
+			d.follower.Unlock()
+
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			if err == errNeedBootstrap {
+				log.Printf("following %s: %s, bootstrapping again", primary, err)
+				if err := d.clearApplied(); err != nil {
+					log.Printf("following %s: %s", primary, err)
+				}
+				continue
+			}
+			log.Printf("following %s: %s", primary, err)
+
+			select {
+			case <-stop:
+				return
+			case <-time.After(FollowRetryInterval):
+			}
+		}
+	}()
+}
+
+// stopFollowing interrupts the replication stream and waits for the follower
+// to wind down
+func (d *Database) stopFollowing() {
+	d.follower.Lock()
+	stop, done := d.follower.stop, d.follower.done
+	if stop == nil {
+		d.follower.Unlock()
+		return
+	}
+	close(stop)
+	if d.follower.body != nil {
+		d.follower.body.Close()
+	}
+	d.follower.stop, d.follower.done = nil, nil
+	d.follower.Unlock()
+
+	<-done
+	atomic.StoreInt32(&d.follower.following, 0)
+	atomic.StoreInt32(&d.follower.bootstrapping, 0)
+}
+
+// openStream GETs a replication endpoint from the primary
+func (d *Database) openStream(url string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if FollowToken != "" {
+		req.Header.Set("Authorization", "Bearer "+FollowToken)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	d.follower.Lock()
+	defer d.follower.Unlock()
+	if d.follower.stop == nil {
+		resp.Body.Close()
+		return nil, errors.New("stopped following")
+	}
+	d.follower.body = resp.Body
+	return resp, nil
+}
+
+func (d *Database) followOnce(primary string) error {
+	applied, ok, err := d.loadApplied()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		if applied, err = d.bootstrap(primary); err != nil {
+			return err
+		}
+	}
+
+	resp, err := d.openStream(fmt.Sprintf("%s/replication/stream?since=%d", primary, applied))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusGone:
+		return errNeedBootstrap
+	default:
+		return fmt.Errorf("replication stream: %s", resp.Status)
+	}
+
+	d.follower.Lock()
+	d.follower.connected = true
+	d.follower.err = nil
+	d.follower.applied = applied
+	d.follower.Unlock()
+
+	// the changes of the primary's txn being received, which are applied
+	// together once they're all here
+	pending := make([]*change, 0)
+
+	dec := codec.NewDecoder(resp.Body, msgpack)
+	for {
+		c := &change{}
+		if err := dec.Decode(c); err != nil {
+			return err
+		}
+
+		switch c.Op {
+		case "heartbeat":
+		case "put", "delete":
+			if prev := applied + uint64(len(pending)); c.Seq != prev+1 {
+				return fmt.Errorf("replication stream skipped from %d to %d", prev, c.Seq)
+			}
+			pending = append(pending, c)
+			if c.Txn > c.Seq {
+				continue
+			}
+			if err := d.applyChanges(pending, c.Seq, false); err != nil {
+				return err
+			}
+			applied = c.Seq
+			pending = pending[:0]
+		default:
+			return errBadStream
+		}
+
+		d.follower.Lock()
+		d.follower.applied = applied
+		if c.Seq > d.follower.primaryLast {
+			d.follower.primaryLast = c.Seq
+		}
+		if applied >= d.follower.primaryLast {
+			d.follower.caughtUp = time.Now()
+		}
+		d.follower.Unlock()
+	}
+}
+
+// bootstrap replaces the local data with a copy of the primary's, and
+// returns the primary's sequence number it corresponds to
+func (d *Database) bootstrap(primary string) (uint64, error) {
+	resp, err := d.openStream(primary + "/replication/bootstrap")
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("replication bootstrap: %s", resp.Status)
+	}
+
+	dec := codec.NewDecoder(resp.Body, msgpack)
+	header := &change{}
+	if err := dec.Decode(header); err != nil {
+		return 0, err
+	}
+	if header.Op != "bootstrap" {
+		return 0, errBadStream
+	}
+
+	// the local data is incomplete from here until the bootstrap finishes
+	atomic.StoreInt32(&d.follower.bootstrapping, 1)
+	if err := d.clearLocal(); err != nil {
+		return 0, err
+	}
+
+	puts := make([]*change, 0, deleteBatchSize)
+	for {
+		c := &change{}
+		if err := dec.Decode(c); err != nil {
+			return 0, err
+		}
+
+		switch c.Op {
+		case "put":
+			puts = append(puts, c)
+			if len(puts) == deleteBatchSize {
+				if err := d.applyChanges(puts, 0, true); err != nil {
+					return 0, err
+				}
+				puts = puts[:0]
+			}
+		case "end":
+			// only now that it's all here do we record where we're up to
+			if err := d.applyChanges(puts, header.Seq, true); err != nil {
+				return 0, err
+			}
+			atomic.StoreInt32(&d.follower.bootstrapping, 0)
+			return header.Seq, nil
+		default:
+			return 0, errBadStream
+		}
+	}
+}
+
+// clearLocal deletes every key, including expired ones, along with the
+// record of what has been applied. None of it is logged, so anyone reading
+// the change log from before has to bootstrap again too.
+func (d *Database) clearLocal() error {
+	if err := d.clearApplied(); err != nil {
+		return err
+	}
+
+	iter := newUserIterator(d.db, nil, &opt.ReadOptions{
+		DontFillCache: true,
+	})
+	defer iter.Release()
+
+	keys := make([][]byte, 0, deleteBatchSize)
+	for iter.First(); iter.Valid(); iter.Next() {
+		keys = append(keys, append([]byte{}, iter.Key()...))
+		if len(keys) == deleteBatchSize {
+			if err := d.deleteKeys(keys, true); err != nil {
+				return err
+			}
+			keys = keys[:0]
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	return d.deleteKeys(keys, true)
+}
+
+func appliedKey() []byte {
+	return metaKey("replication", []byte("applied"))
+}
+
+// loadApplied gets the last of the primary's sequence numbers applied here,
+// and whether there is one at all (there isn't until bootstrap finishes)
+func (d *Database) loadApplied() (uint64, bool, error) {
+	b, err := d.db.Get(appliedKey(), nil)
+	if err == leveldb.ErrNotFound {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+	return binary.BigEndian.Uint64(b), true, nil
+}
+
+func (d *Database) clearApplied() error {
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+
+	t := d.newTxn()
+	t.unlogged = true
+	t.batch.Delete(appliedKey())
+	return t.write()
+}
+
+// applyChanges writes changes from the primary in a single batch. If seq is
+// nonzero it is recorded as applied in the same batch. A bootstrap's puts are
+// a copy of the primary rather than changes, so they aren't logged or
+// published.
+func (d *Database) applyChanges(changes []*change, seq uint64, bootstrap bool) error {
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+
+	t := d.newTxn()
+	t.unlogged = bootstrap
+	for _, c := range changes {
+		var err error
+		if c.Op == "put" {
+			err = t.put([]byte(c.Key), []byte(c.Value), c.ExpiresAt)
+		} else {
+			err = t.del([]byte(c.Key))
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if seq != 0 {
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, seq)
+		t.batch.Put(appliedKey(), b)
+	}
+	return t.write()
+}
+
+// writable wraps a handler that writes to the db, so that it's refused while
+// following a primary
+func (d *Database) writable(handle httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		if d.isFollowing() {
+			failCode(w, http.StatusForbidden)
+			return
+		}
+		handle(w, r, p)
+	}
+}
+
+// loaded wraps a handler that reads the db's data, so that it 503s while a
+// follower's bootstrap leaves the data incomplete
+func (d *Database) loaded(handle httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		if atomic.LoadInt32(&d.follower.bootstrapping) != 0 {
+			failCode(w, http.StatusServiceUnavailable)
+			return
+		}
+		handle(w, r, p)
+	}
+}
+
+type replicationState struct {
+	Role        string  `codec:"role"`
+	Last        uint64  `codec:"last"`
+	Primary     string  `codec:"primary,omitempty"`
+	Applied     uint64  `codec:"applied,omitempty"`
+	PrimaryLast uint64  `codec:"primary_last,omitempty"`
+	Lag         uint64  `codec:"lag,omitempty"`
+	LagSeconds  float64 `codec:"lag_seconds,omitempty"`
+	Connected   bool    `codec:"connected,omitempty"`
+	Bootstrap   bool    `codec:"bootstrapping,omitempty"`
+	Error       string  `codec:"error,omitempty"`
+}
+
+// followStatus describes the database's part in replication. A follower's lag
+// is how many of the primary's changes it has yet to apply, and how long it
+// has been since it last had them all.
+func (d *Database) followStatus() *replicationState {
+	st := &replicationState{
+		Role: "primary",
+		Last: atomic.LoadUint64(&d.lastSeq),
+	}
+	if !d.isFollowing() {
+		return st
+	}
+
+	d.follower.Lock()
+	defer d.follower.Unlock()
+
+	st.Role = "follower"
+	st.Primary = d.follower.primary
+	st.Applied = d.follower.applied
+	st.PrimaryLast = d.follower.primaryLast
+	st.Connected = d.follower.connected
+	st.Bootstrap = atomic.LoadInt32(&d.follower.bootstrapping) != 0
+	if d.follower.err != nil {
+		st.Error = d.follower.err.Error()
+	}
+	if d.follower.primaryLast > d.follower.applied {
+		st.Lag = d.follower.primaryLast - d.follower.applied
+		if !d.follower.caughtUp.IsZero() {
+			st.LagSeconds = time.Since(d.follower.caughtUp).Seconds()
+		}
+	}
+	return st
+}
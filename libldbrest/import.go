@@ -0,0 +1,212 @@
+package libldbrest
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/ugorji/go/codec"
+)
+
+// how many records an import writes at a time
+const importBatchSize = 1000
+
+type importRecord struct {
+	Key       string  `codec:"key"`
+	Value     string  `codec:"value"`
+	TTL       int64   `codec:"ttl,omitempty"`
+	ExpiresAt int64   `codec:"expires_at,omitempty"`
+	CRC       *uint32 `codec:"crc,omitempty"`
+
+	// set in the header and trailer of an export rather than key records
+	Format  string `codec:"format,omitempty"`
+	Version int    `codec:"version,omitempty"`
+	Count   *int   `codec:"count,omitempty"`
+}
+
+// importMode says what an import does about keys that already exist
+type importMode int
+
+const (
+	importOverwrite importMode = iota
+	importSkip
+	importReject
+)
+
+var (
+	errBadImportMode = errors.New("bad import mode")
+	errKeyExists     = errors.New("key already exists")
+)
+
+func importModeFromQuery(q url.Values) (importMode, error) {
+	switch q.Get("existing") {
+	case "", "overwrite":
+		return importOverwrite, nil
+	case "skip":
+		return importSkip, nil
+	case "reject":
+		return importReject, nil
+	default:
+		return importOverwrite, errBadImportMode
+	}
+}
+
+// importResult tallies up an import, and says where and why it stopped if
+// it didn't make it to the end
+type importResult struct {
+	Imported int    `codec:"imported"`
+	Skipped  int    `codec:"skipped"`
+	Offset   *int   `codec:"offset,omitempty"`
+	Error    string `codec:"error,omitempty"`
+}
+
+// importError is what importRecords returns when it stopped at a record.
+// Every record before the offset was written, and none from it on.
+type importError struct {
+	Offset int
+	Err    error
+}
+
+func (ie *importError) Error() string {
+	return fmt.Sprintf("import stopped at record %d: %s", ie.Offset, ie.Err)
+}
+
+// importRecords writes every record decoded from the stream, importBatchSize
+// of them at a time. If the stream is an export (see export.go) it is checked
+// as it goes. If unlogged, the writes skip the change log (see txn.unlogged).
+func (d *Database) importRecords(dec *codec.Decoder, mode importMode, unlogged bool) (*importResult, error) {
+	res := &importResult{}
+	recs := make([]*importRecord, 0, importBatchSize)
+	var offset int
+
+	flush := func() error {
+		if err := d.importBatch(recs, offset, mode, unlogged, res); err != nil {
+			return err
+		}
+		offset += len(recs)
+		recs = recs[:0]
+		return nil
+	}
+
+	var export, ended bool
+	for first := true; ; first = false {
+		rec := &importRecord{}
+		err := dec.Decode(rec)
+		if err == io.EOF {
+			if !export || ended {
+				break
+			}
+			err = errExportTrunc
+		}
+
+		if err == nil && first && rec.Format != "" {
+			if rec.Format != exportFormat {
+				err = errBadExport
+			} else if rec.Version != exportVersion {
+				err = errExportVersion
+			} else {
+				export = true
+				continue
+			}
+		}
+
+		if err == nil && export {
+			switch {
+			case ended:
+				err = errBadExport
+			case rec.Count != nil:
+				ended = true
+				if *rec.Count != offset+len(recs) {
+					err = errExportCount
+				} else {
+					continue
+				}
+			case rec.CRC == nil || *rec.CRC != recordChecksum(rec.Key, rec.Value, rec.ExpiresAt):
+				err = errExportChecksum
+			}
+		}
+
+		if err != nil {
+			if ferr := flush(); ferr != nil {
+				return res, ferr
+			}
+			return res, &importError{offset, err}
+		}
+
+		recs = append(recs, rec)
+		if len(recs) == importBatchSize {
+			if err := flush(); err != nil {
+				return res, err
+			}
+		}
+	}
+
+	return res, flush()
+}
+
+// importBatch writes the records up to the first one that can't be imported,
+// and if there is one returns an *importError for it. offset is the position
+// of the batch's first record in the whole import.
+func (d *Database) importBatch(recs []*importRecord, offset int, mode importMode, unlogged bool, res *importResult) error {
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+
+	var (
+		t       = d.newTxn()
+		seen    = make(map[string]bool, len(recs))
+		skipped int
+		i       int
+		failed  error
+	)
+	t.unlogged = unlogged
+	for i = 0; i < len(recs); i++ {
+		rec := recs[i]
+		key := []byte(rec.Key)
+
+		expires, err := expiresAt(rec.TTL, rec.ExpiresAt)
+		if err != nil {
+			failed = err
+			break
+		}
+
+		if mode != importOverwrite {
+			exists := seen[rec.Key]
+			if !exists {
+				if _, err := get(d.db, key); err == nil {
+					exists = true
+				} else if err != leveldb.ErrNotFound {
+					return err
+				}
+			}
+			if exists && mode == importSkip {
+				skipped++
+				continue
+			}
+			if exists {
+				failed = errKeyExists
+				break
+			}
+		}
+
+		if err := t.put(key, []byte(rec.Value), expires); err == errReservedKey {
+			failed = err
+			break
+		} else if err != nil {
+			return err
+		}
+		seen[rec.Key] = true
+	}
+
+	if err := t.write(); err != nil {
+		return err
+	}
+	res.Imported += i - skipped
+	res.Skipped += skipped
+
+	if failed != nil {
+		return &importError{offset + i, failed}
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package libldbrest
+
+import (
+	"strconv"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// counter values are stored as decimal strings
+type counter struct {
+	Key   string `codec:"key"`
+	Value int64  `codec:"value"`
+}
+
+// notCounterError is returned by incrKeys when a key it would increment
+// holds something other than an integer
+type notCounterError struct {
+	Key string `codec:"key"`
+}
+
+func (nce *notCounterError) Error() string {
+	return "not an integer value: " + strconv.Quote(nce.Key)
+}
+
+// counterOverflowError is returned by incrKeys when an increment would take a
+// key's value outside the range of an int64
+type counterOverflowError struct {
+	Key string `codec:"key"`
+}
+
+func (coe *counterOverflowError) Error() string {
+	return "integer value would overflow: " + strconv.Quote(coe.Key)
+}
+
+// incrKeys atomically adds deltas to the integer values of keys (which are
+// treated as zero if they don't exist), and returns the new values.
+func (d *Database) incrKeys(incrs []*counter) ([]*counter, error) {
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+
+	var (
+		t       = d.newTxn()
+		pending = make(map[string]int64)
+		results = make([]*counter, 0, len(incrs))
+	)
+
+	for _, incr := range incrs {
+		key := []byte(incr.Key)
+
+		current, exists := pending[incr.Key]
+		if !exists {
+			var err error
+			if current, exists, err = d.counterValue(key); err != nil {
+				return nil, err
+			}
+		}
+
+		// an existing counter keeps its expiry, but a missing
+		// (or expired) one starts over from zero without one
+		var expires int64
+		if exists {
+			var err error
+			if expires, err = t.expiry(key); err != nil {
+				return nil, err
+			}
+		}
+
+		sum := current + incr.Value
+		if (incr.Value > 0 && sum < current) || (incr.Value < 0 && sum > current) {
+			return nil, &counterOverflowError{incr.Key}
+		}
+		current = sum
+		pending[incr.Key] = current
+		if err := t.put(key, []byte(strconv.FormatInt(current, 10)), expires); err != nil {
+			return nil, err
+		}
+		results = append(results, &counter{incr.Key, current})
+	}
+
+	if err := t.write(); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// counterValue gets the current integer value of a key, and whether it exists
+func (d *Database) counterValue(key []byte) (int64, bool, error) {
+	val, err := get(d.db, key)
+	if err == leveldb.ErrNotFound {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+
+	current, err := strconv.ParseInt(string(val), 10, 64)
+	if err != nil {
+		return 0, true, &notCounterError{string(key)}
+	}
+	return current, true, nil
+}
@@ -2,17 +2,24 @@ package libldbrest
 
 import (
 	"bytes"
+	"time"
 
 	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
-func iterate(start []byte, include_start, backwards bool, handle func([]byte, []byte) (bool, error)) error {
-	iter := db.NewIterator(
-		nil,
+func iterate(src reader, slice *util.Range, start []byte, include_start, backwards bool, handle func([]byte, []byte) (bool, error)) error {
+	iter := newUserIterator(
+		src,
+		slice,
 		&opt.ReadOptions{
 			DontFillCache: true,
 		},
 	)
+	defer iter.Release()
+
+	expiries := newExpiryCursor(src, backwards)
+	defer expiries.release()
 
 	if bytes.Equal(start, []byte{}) {
 		if backwards {
@@ -22,25 +29,25 @@ func iterate(start []byte, include_start, backwards bool, handle func([]byte, []
 		}
 	} else {
 		iter.Seek(start)
-	}
-
-	var proceed func() bool
-
-	if backwards {
-		proceed = iter.Prev
 
 		// Iterator.Seek() seeks to the first key >= its argument, but going
 		// backwards we need the last key <= the arg, so adjust accordingly
-		if !iter.Valid() {
-			iter.Last()
-		} else if !include_start && !bytes.Equal(iter.Key(), start) {
-			iter.Prev()
+		if backwards {
+			if !iter.Valid() {
+				iter.Last()
+			} else if !bytes.Equal(iter.Key(), start) {
+				iter.Prev()
+			}
 		}
-	} else {
-		proceed = iter.Next
+	}
+
+	proceed := iter.Next
+	if backwards {
+		proceed = iter.Prev
 	}
 
 	first := true
+	now := time.Now().Unix()
 
 	for ; iter.Valid(); proceed() {
 		if first && !include_start && bytes.Equal(iter.Key(), start) {
@@ -49,6 +56,14 @@ func iterate(start []byte, include_start, backwards bool, handle func([]byte, []
 		}
 		first = false
 
+		expired, err := expiries.isExpired(iter.Key(), now)
+		if err != nil {
+			return err
+		}
+		if expired {
+			continue
+		}
+
 		stop, err := handle(iter.Key(), iter.Value())
 		if err != nil {
 			return err
@@ -62,7 +77,7 @@ func iterate(start []byte, include_start, backwards bool, handle func([]byte, []
 	return nil
 }
 
-func iterateUntil(start, end []byte, max int, include_start, include_end, backwards bool, handle func([]byte, []byte) error) (bool, error) {
+func iterateUntil(src reader, slice *util.Range, start, end []byte, max int, include_start, include_end, backwards bool, handle func([]byte, []byte) error) (bool, error) {
 	var (
 		i    int
 		more bool
@@ -80,7 +95,7 @@ func iterateUntil(start, end []byte, max int, include_start, include_end, backwa
 		}
 	}
 
-	err := iterate(start, include_start, backwards, func(key, value []byte) (bool, error) {
+	err := iterate(src, slice, start, include_start, backwards, func(key, value []byte) (bool, error) {
 		if i >= max {
 			// exceeded max count, indicate if there's more before "end"
 			more, _ = oob(key)
@@ -103,13 +118,21 @@ func iterateUntil(start, end []byte, max int, include_start, include_end, backwa
 	return more, err
 }
 
-func iterateN(start []byte, max int, include_start, backwards bool, handle func([]byte, []byte) error) error {
-	var i int
-	return iterate(start, include_start, backwards, func(key, value []byte) (bool, error) {
+func iterateN(src reader, slice *util.Range, start []byte, max int, include_start, backwards bool, handle func([]byte, []byte) error) (bool, error) {
+	var (
+		i    int
+		more bool
+	)
+
+	err := iterate(src, slice, start, include_start, backwards, func(key, value []byte) (bool, error) {
 		if i >= max {
+			// there is at least this one more key
+			more = true
 			return true, nil
 		}
 		i++
 		return false, handle(key, value)
 	})
+
+	return more, err
 }
@@ -1,17 +1,26 @@
 package libldbrest
 
 import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
 	"github.com/ugorji/go/codec"
 )
 
@@ -114,6 +123,56 @@ func TestDelete(t *testing.T) {
 	}
 }
 
+func TestConditionalWrites(t *testing.T) {
+	dbpath := setup(t)
+	defer cleanup(dbpath)
+
+	app := newAppTester(t)
+
+	rr := app.doReqHeaders("PUT", "http://domain/key/foo", "one", map[string]string{
+		"If-None-Match": "*",
+	})
+	assert(t, rr.Code == 204, "create-only PUT of new key failed: %d", rr.Code)
+
+	rr = app.doReqHeaders("PUT", "http://domain/key/foo", "two", map[string]string{
+		"If-None-Match": "*",
+	})
+	assert(t, rr.Code == 412, "create-only PUT of existing key should 412: %d", rr.Code)
+
+	rr = app.doReq("GET", "http://domain/key/foo", "")
+	tag := rr.HeaderMap.Get("ETag")
+	assert(t, tag == etag([]byte("one")), "wrong ETag for 'foo': %s", tag)
+
+	rr = app.doReqHeaders("PUT", "http://domain/key/foo", "two", map[string]string{
+		"If-Match": tag,
+	})
+	assert(t, rr.Code == 204, "PUT with matching ETag failed: %d", rr.Code)
+
+	// the same ETag is now stale
+	b := make([]byte, 0)
+	codec.NewEncoderBytes(&b, msgpack).Encode(keyval{"foo", "three"})
+	rr = app.doReqHeaders("POST", "http://domain/key", string(b), map[string]string{
+		"If-Match": tag,
+	})
+	assert(t, rr.Code == 412, "POST with stale ETag should 412: %d", rr.Code)
+	assert(t, app.get("foo") == "two", "stale write went through")
+
+	rr = app.doReqHeaders("DELETE", "http://domain/key/foo", "", map[string]string{
+		"If-Match": tag,
+	})
+	assert(t, rr.Code == 412, "DELETE with stale ETag should 412: %d", rr.Code)
+
+	rr = app.doReqHeaders("DELETE", "http://domain/key/foo", "", map[string]string{
+		"If-Match": etag([]byte("two")),
+	})
+	assert(t, rr.Code == 204, "DELETE with matching ETag failed: %d", rr.Code)
+
+	rr = app.doReqHeaders("DELETE", "http://domain/key/foo", "", map[string]string{
+		"If-Match": "*",
+	})
+	assert(t, rr.Code == 412, "DELETE of missing key with If-Match: * should 412: %d", rr.Code)
+}
+
 func TestIteration(t *testing.T) {
 	dbpath := setup(t)
 	defer cleanup(dbpath)
@@ -157,7 +216,7 @@ func TestIteration(t *testing.T) {
 	assert(t, kvresp.Data[0].Value == "A", "wrong first value: %s", kvresp.Data[0].Value)
 	assert(t, kvresp.Data[1].Key == "b", "wrong second key: %s", kvresp.Data[1].Key)
 	assert(t, kvresp.Data[1].Value == "B", "wrong second value: %s", kvresp.Data[1].Value)
-	assert(t, !*kvresp.More, "ldbrest falsely reporting 'more'")
+	assert(t, *kvresp.More, "'more' should be true (no end)")
 
 	/*
 		keys and vals [a, d] with max 3 (trigger 'more')
@@ -198,6 +257,268 @@ func TestIteration(t *testing.T) {
 	assert(t, kresp.Data[1].Key == "c", "wrong data[1]: %s", kresp.Data[1])
 }
 
+func TestPrefixIteration(t *testing.T) {
+	dbpath := setup(t)
+	defer cleanup(dbpath)
+
+	app := newAppTester(t)
+
+	app.put("user:1", "x")
+	app.put("user:12:a", "A")
+	app.put("user:12:b", "B")
+	app.put("user:12:c", "C")
+	app.put("user:13", "y")
+
+	iter := func(query string) *multiResponse {
+		resp := &multiResponse{}
+		app.decode(app.doReq("GET", "http://domain/iterate?"+query, ""), 200, resp)
+		return resp
+	}
+
+	resp := iter("prefix=user:12:")
+	assert(t, len(resp.Data) == 3, "wrong # of prefixed keys: %d", len(resp.Data))
+	assert(t, resp.Data[0].Key == "user:12:a", "wrong data[0].Key: %s", resp.Data[0].Key)
+	assert(t, resp.Data[2].Key == "user:12:c", "wrong data[2].Key: %s", resp.Data[2].Key)
+	assert(t, !*resp.More, "ldbrest falsely reporting 'more'")
+
+	resp = iter("prefix=user:12:&max=2")
+	assert(t, len(resp.Data) == 2, "wrong # of prefixed keys: %d", len(resp.Data))
+	assert(t, *resp.More, "'more' should be true (prefix)")
+
+	resp = iter("prefix=user:12:&forward=no")
+	assert(t, len(resp.Data) == 3, "wrong # of prefixed keys: %d", len(resp.Data))
+	assert(t, resp.Data[0].Key == "user:12:c", "wrong data[0].Key: %s", resp.Data[0].Key)
+	assert(t, resp.Data[2].Key == "user:12:a", "wrong data[2].Key: %s", resp.Data[2].Key)
+
+	resp = iter("prefix=user:12:&start=user:12:b&include_start=no")
+	assert(t, len(resp.Data) == 1, "wrong # of prefixed keys: %d", len(resp.Data))
+	assert(t, resp.Data[0].Key == "user:12:c", "wrong data[0].Key: %s", resp.Data[0].Key)
+
+	resp = iter("prefix=user:12:&start=user:12:bb&forward=no")
+	assert(t, len(resp.Data) == 2, "wrong # of prefixed keys: %d", len(resp.Data))
+	assert(t, resp.Data[0].Key == "user:12:b", "wrong data[0].Key: %s", resp.Data[0].Key)
+}
+
+func TestCursorPagination(t *testing.T) {
+	dbpath := setup(t)
+	defer cleanup(dbpath)
+
+	app := newAppTester(t)
+
+	for _, k := range []string{"a", "b", "c", "d", "e", "f"} {
+		app.put(k, strings.ToUpper(k))
+	}
+
+	page := func(query string) *multiResponse {
+		resp := &multiResponse{}
+		app.decode(app.doReq("GET", "http://domain/iterate?"+query, ""), 200, resp)
+		return resp
+	}
+
+	// reverse from "e" down to (but excluding) "a", two at a time
+	keys := make([]string, 0)
+	resp := page("start=e&end=a&forward=no&max=2")
+	for {
+		for _, kv := range resp.Data {
+			keys = append(keys, kv.Key)
+		}
+		if !*resp.More {
+			assert(t, resp.Cursor == "", "cursor without 'more': %s", resp.Cursor)
+			break
+		}
+		assert(t, resp.Cursor != "", "'more' without a cursor")
+		resp = page("max=2&cursor=" + url.QueryEscape(resp.Cursor))
+	}
+
+	assert(t, strings.Join(keys, "") == "edcb", "wrong paginated keys: %v", keys)
+
+	rr := app.doReq("GET", "http://domain/iterate?cursor=nope", "")
+	assert(t, rr.Code == 400, "expected 400 for a bad cursor, got %d", rr.Code)
+}
+
+func TestStreamingIteration(t *testing.T) {
+	dbpath := setup(t)
+	defer cleanup(dbpath)
+
+	app := newAppTester(t)
+
+	ops := make(oplist, 0, ABSMAX+500)
+	for i := 0; i < ABSMAX+500; i++ {
+		key := fmt.Sprintf("%05d", i)
+		ops = append(ops, oplist{{Op: "put", Key: key, Value: key}}...)
+	}
+	if !app.batch(ops) {
+		t.Fatal("batch call failed")
+	}
+
+	rr := app.doReq("GET", "http://domain/iterate?stream=yes", "")
+	assert(t, rr.Code == 200, "bad streaming GET /iterate response: %d", rr.Code)
+	dec := codec.NewDecoder(rr.Body, msgpack)
+	var n int
+	for {
+		kv := &keyval{}
+		if err := dec.Decode(kv); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		assert(t, kv.Key == fmt.Sprintf("%05d", n), "wrong streamed key: %s", kv.Key)
+		n++
+	}
+	assert(t, n == ABSMAX+500, "wrong # of streamed keys: %d", n)
+
+	rr = app.doReqHeaders("GET", "http://domain/iterate?stream=yes&prefix=000&max=5", "", map[string]string{
+		"Accept": jsonCType,
+	})
+	assert(t, rr.Code == 200, "bad streaming GET /iterate response: %d", rr.Code)
+	ct := rr.HeaderMap.Get("Content-Type")
+	assert(t, ct == ndjsonCType, "wrong streaming content-type: %s", ct)
+	lines := strings.Split(strings.TrimSpace(rr.Body.String()), "\n")
+	assert(t, len(lines) == 5, "wrong # of NDJSON lines: %d", len(lines))
+	kv := &keyval{}
+	if err := codec.NewDecoderBytes([]byte(lines[4]), handles[jsonCType]).Decode(kv); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, kv.Key == "00004", "wrong last NDJSON key: %s", kv.Key)
+}
+
+func TestFieldSelection(t *testing.T) {
+	dbpath := setup(t)
+	defer cleanup(dbpath)
+
+	app := newAppTester(t)
+
+	app.put("a", "A")
+	app.put("b", "B")
+
+	decodeMaps := func(rr *httptest.ResponseRecorder) []map[string]string {
+		resp := &struct {
+			Data []map[string]string `codec:"data"`
+		}{}
+		app.decode(rr, 200, resp)
+		return resp.Data
+	}
+
+	data := decodeMaps(app.doReq("GET", "http://domain/iterate?fields=keys", ""))
+	assert(t, len(data) == 2, "wrong # of records: %d", len(data))
+	_, hasValue := data[0]["value"]
+	assert(t, data[0]["key"] == "a" && !hasValue, "bad keys-only record: %v", data[0])
+
+	data = decodeMaps(app.doReq("GET", "http://domain/iterate?fields=values", ""))
+	assert(t, len(data) == 2, "wrong # of records: %d", len(data))
+	_, hasKey := data[1]["key"]
+	assert(t, data[1]["value"] == "B" && !hasKey, "bad values-only record: %v", data[1])
+
+	b := make([]byte, 0)
+	codec.NewEncoderBytes(&b, msgpack).Encode(map[string][]string{"keys": {"a", "c"}})
+	data = decodeMaps(app.doReq("POST", "http://domain/keys?fields=keys", string(b)))
+	assert(t, len(data) == 1, "wrong # of records: %d", len(data))
+	_, hasValue = data[0]["value"]
+	assert(t, data[0]["key"] == "a" && !hasValue, "bad keys-only record: %v", data[0])
+
+	rr := app.doReq("GET", "http://domain/iterate?fields=nope", "")
+	assert(t, rr.Code == 400, "expected 400 for bad fields, got %d", rr.Code)
+}
+
+func TestCount(t *testing.T) {
+	dbpath := setup(t)
+	defer cleanup(dbpath)
+
+	app := newAppTester(t)
+
+	ops := make(oplist, 0, 2*countSample)
+	for i := 0; i < 2*countSample; i++ {
+		key := fmt.Sprintf("k%05d", i)
+		ops = append(ops, oplist{{Op: "put", Key: key, Value: strings.Repeat("v", 100)}}...)
+	}
+	app.batch(ops)
+	app.put("x", "X")
+
+	count := func(query string) (int, bool) {
+		resp := &struct {
+			Count       int  `codec:"count"`
+			Approximate bool `codec:"approximate"`
+		}{}
+		app.decode(app.doReq("GET", "http://domain/count?"+query, ""), 200, resp)
+		return resp.Count, resp.Approximate
+	}
+
+	n, _ := count("")
+	assert(t, n == 2*countSample+1, "wrong total count: %d", n)
+
+	n, _ = count("prefix=k")
+	assert(t, n == 2*countSample, "wrong prefix count: %d", n)
+
+	n, _ = count("start=k00010&end=k00020")
+	assert(t, n == 10, "wrong range count: %d", n)
+
+	n, _ = count("start=k00020&end=k00010&forward=no&include_end=yes")
+	assert(t, n == 11, "wrong reverse range count: %d", n)
+
+	n, approx := count("start=k00010&end=k00020&approximate=yes")
+	assert(t, n == 10 && !approx, "small range should be counted exactly: %d", n)
+
+	// nothing has hit disk yet, so there's nothing to estimate from
+	n, approx = count("prefix=k&approximate=yes")
+	assert(t, n == 2*countSample && !approx, "in-memory range should be counted exactly: %d %v", n, approx)
+
+	if err := defaultDB.db.CompactRange(util.Range{}); err != nil {
+		t.Fatal(err)
+	}
+	n, approx = count("prefix=k&approximate=yes")
+	assert(t, approx, "big range wasn't estimated")
+	assert(t, n > 3*countSample/2 && n < 5*countSample/2, "estimate way off: %d", n)
+
+	// newer keys in front of those on disk, covering all of the sample
+	ops = ops[:0]
+	for i := 0; i < 3*countSample/2; i++ {
+		ops = append(ops, oplist{{Op: "put", Key: fmt.Sprintf("j%05d", i), Value: "v"}}...)
+	}
+	app.batch(ops)
+	n, approx = count("start=j&approximate=yes")
+	assert(t, n == 7*countSample/2+1 && !approx, "range starting in memory should be counted exactly: %d %v", n, approx)
+}
+
+func TestDeleteRange(t *testing.T) {
+	dbpath := setup(t)
+	defer cleanup(dbpath)
+
+	app := newAppTester(t)
+
+	ops := make(oplist, 0, 2500)
+	for i := 0; i < 2500; i++ {
+		key := fmt.Sprintf("k%05d", i)
+		ops = append(ops, oplist{{Op: "put", Key: key, Value: key}}...)
+	}
+	app.batch(ops)
+	app.put("a", "A")
+	app.put("z", "Z")
+
+	deleted := func(query string) int {
+		resp := &struct {
+			Deleted int `codec:"deleted"`
+		}{}
+		app.decode(app.doReq("DELETE", "http://domain/range?"+query, ""), 200, resp)
+		return resp.Deleted
+	}
+
+	n := deleted("start=k00000&end=k00010")
+	assert(t, n == 10, "wrong # of deleted keys: %d", n)
+	found, _ := app.maybeGet("k00009")
+	assert(t, !found, "k00009 survived range delete")
+	assert(t, app.get("k00010") == "k00010", "k00010 wrongly deleted")
+
+	n = deleted("prefix=k&compact=yes")
+	assert(t, n == 2490, "wrong # of deleted keys: %d", n)
+	found, _ = app.maybeGet("k02499")
+	assert(t, !found, "k02499 survived prefix delete")
+	assert(t, app.get("a") == "A", "'a' wrongly deleted")
+	assert(t, app.get("z") == "Z", "'z' wrongly deleted")
+
+	rr := app.doReq("DELETE", "http://domain/range", "")
+	assert(t, rr.Code == 400, "expected 400 for unbounded range, got %d", rr.Code)
+}
+
 func TestBatch(t *testing.T) {
 	dbpath := setup(t)
 	defer cleanup(dbpath)
@@ -206,9 +527,9 @@ func TestBatch(t *testing.T) {
 	app.put("foo", "bar")
 
 	if !app.batch(oplist{
-		{"put", "a", "A"},
-		{"put", "b", "B"},
-		{"delete", "foo", ""},
+		{Op: "put", Key: "a", Value: "A"},
+		{Op: "put", Key: "b", Value: "B"},
+		{Op: "delete", Key: "foo"},
 	}) {
 		t.Fatal("batch call failed")
 	}
@@ -222,16 +543,1243 @@ func TestBatch(t *testing.T) {
 	}
 }
 
+func TestContentNegotiation(t *testing.T) {
+	dbpath := setup(t)
+	defer cleanup(dbpath)
+
+	app := newAppTester(t)
+
+	rr := app.doReqHeaders("POST", "http://domain/key", `{"key":"foo","value":"bar"}`, map[string]string{
+		"Content-Type": jsonCType,
+	})
+	assert(t, rr.Code == 204, "bad JSON POST /key response: %d", rr.Code)
+
+	rr = app.doReqHeaders("GET", "http://domain/key/foo", "", map[string]string{
+		"Accept": "application/msgpack;q=0.5, application/json",
+	})
+	ct := rr.HeaderMap.Get("Content-Type")
+	assert(t, ct == jsonCType, "wrong negotiated content-type: %s", ct)
+	kv := &keyval{}
+	app.decode(rr, 200, kv)
+	assert(t, kv.Value == "bar", "wrong 'foo' value: %s", kv.Value)
+
+	for _, ctype := range []string{cborCType, bincCType} {
+		rr = app.doReqHeaders("GET", "http://domain/iterate", "", map[string]string{
+			"Accept": ctype,
+		})
+		resp := &multiResponse{}
+		app.decode(rr, 200, resp)
+		assert(t, len(resp.Data) == 1, "wrong # of keyvals (%s): %d", ctype, len(resp.Data))
+	}
+
+	// defaults to msgpack when anything goes
+	assert(t, app.get("foo") == "bar", "wrong msgpack 'foo' value")
+
+	rr = app.doReqHeaders("POST", "http://domain/key", "<xml/>", map[string]string{
+		"Content-Type": "application/xml",
+	})
+	assert(t, rr.Code == 415, "expected 415 for xml body, got %d", rr.Code)
+
+	rr = app.doReqHeaders("GET", "http://domain/key/foo", "", map[string]string{
+		"Accept": "text/html, application/msgpack;q=0",
+	})
+	assert(t, rr.Code == 406, "expected 406 for html, got %d", rr.Code)
+
+	// writes get their 406 before doing anything
+	html := map[string]string{"Accept": "text/html"}
+	rr = app.doReqHeaders("DELETE", "http://domain/range?start=a", "", html)
+	assert(t, rr.Code == 406, "expected 406 for html DELETE /range, got %d", rr.Code)
+	assert(t, app.get("foo") == "bar", "unacceptable DELETE /range deleted anyway")
+	rr = app.doReqHeaders("POST", "http://domain/incr/hits", "", html)
+	assert(t, rr.Code == 406, "expected 406 for html POST /incr, got %d", rr.Code)
+	found, _ := app.maybeGet("hits")
+	assert(t, !found, "unacceptable POST /incr incremented anyway")
+	rr = app.doReqHeaders("POST", "http://domain/snapshots", "", html)
+	assert(t, rr.Code == 406, "expected 406 for html POST /snapshots, got %d", rr.Code)
+	assert(t, len(defaultDB.snapshots.m) == 0, "unacceptable POST /snapshots leaked a snapshot")
+}
+
+func TestRawValues(t *testing.T) {
+	dbpath := setup(t)
+	defer cleanup(dbpath)
+
+	app := newAppTester(t)
+
+	blob := "\x89PNG\r\n\x1a\n\x00\xff"
+	rr := app.doReq("PUT", "http://domain/key/img/1", blob)
+	assert(t, rr.Code == 204, "bad PUT /key/img/1 response: %d", rr.Code)
+
+	rr = app.doReqHeaders("GET", "http://domain/key/img/1", "", map[string]string{
+		"Accept": rawCType,
+	})
+	assert(t, rr.Code == 200, "bad raw GET /key/img/1 response: %d", rr.Code)
+	ct := rr.HeaderMap.Get("Content-Type")
+	assert(t, ct == rawCType, "wrong raw content-type: %s", ct)
+	assert(t, rr.Body.String() == blob, "wrong raw value: %q", rr.Body.String())
+
+	rr = app.doReq("GET", "http://domain/key/img/1?raw=yes", "")
+	assert(t, rr.Code == 200, "bad raw GET /key/img/1 response: %d", rr.Code)
+	assert(t, rr.Body.String() == blob, "wrong raw value: %q", rr.Body.String())
+
+	// still available wrapped in a key/value object
+	assert(t, app.get("img/1") == blob, "wrong encoded value for raw PUT")
+}
+
+func TestBatchChecks(t *testing.T) {
+	dbpath := setup(t)
+	defer cleanup(dbpath)
+
+	app := newAppTester(t)
+	app.put("foo", "bar")
+
+	if !app.batch(oplist{
+		{Op: "check_equals", Key: "foo", Value: "bar"},
+		{Op: "check_present", Key: "foo"},
+		{Op: "check_absent", Key: "a"},
+		{Op: "put", Key: "a", Value: "A"},
+	}) {
+		t.Fatal("batch with passing checks failed")
+	}
+	assert(t, app.get("a") == "A", "put in the checked batch didn't go through")
+
+	b := make([]byte, 0)
+	codec.NewEncoderBytes(&b, msgpack).Encode(struct {
+		Ops oplist `codec:"ops"`
+	}{oplist{
+		{Op: "put", Key: "b", Value: "B"},
+		{Op: "check_equals", Key: "foo", Value: "bar"},
+		{Op: "check_absent", Key: "a"},
+	}})
+	rr := app.doReq("POST", "http://domain/batch", string(b))
+
+	failure := &batchCheckError{}
+	app.decode(rr, 409, failure)
+	assert(t, failure.Index == 2 && failure.Key == "a", "wrong failed check: %v", failure)
+
+	found, _ := app.maybeGet("b")
+	assert(t, !found, "put in a failed batch went through")
+}
+
+func TestIncrement(t *testing.T) {
+	dbpath := setup(t)
+	defer cleanup(dbpath)
+
+	app := newAppTester(t)
+
+	incr := func(url string) *counter {
+		c := &counter{}
+		app.decode(app.doReq("POST", url, ""), 200, c)
+		return c
+	}
+
+	c := incr("http://domain/incr/hits")
+	assert(t, c.Key == "hits" && c.Value == 1, "wrong first increment: %v", c)
+	c = incr("http://domain/incr/hits?delta=41")
+	assert(t, c.Value == 42, "wrong second increment: %d", c.Value)
+	assert(t, app.get("hits") == "42", "wrong stored counter: %s", app.get("hits"))
+
+	b := make([]byte, 0)
+	codec.NewEncoderBytes(&b, msgpack).Encode(map[string][]*counter{
+		"incrs": {{"hits", -2}, {"misses", 5}, {"hits", 10}},
+	})
+	rr := app.doReq("POST", "http://domain/incr", string(b))
+	resp := &struct {
+		Data []*counter `codec:"data"`
+	}{}
+	app.decode(rr, 200, resp)
+	assert(t, len(resp.Data) == 3, "wrong # of results: %d", len(resp.Data))
+	assert(t, resp.Data[2].Value == 50, "wrong batched increment: %d", resp.Data[2].Value)
+	assert(t, app.get("misses") == "5", "wrong stored counter: %s", app.get("misses"))
+
+	app.put("name", "bob")
+	rr = app.doReq("POST", "http://domain/incr/name", "")
+	assert(t, rr.Code == 409, "incrementing a non-integer should 409: %d", rr.Code)
+	assert(t, app.get("name") == "bob", "non-integer value was clobbered")
+
+	app.put("big", "9223372036854775807")
+	rr = app.doReq("POST", "http://domain/incr/big", "")
+	assert(t, rr.Code == 409, "overflowing increment should 409: %d", rr.Code)
+	app.put("small", "-9223372036854775807")
+	rr = app.doReq("POST", "http://domain/incr/small?delta=-2", "")
+	assert(t, rr.Code == 409, "underflowing increment should 409: %d", rr.Code)
+	assert(t, app.get("big") == "9223372036854775807" && app.get("small") == "-9223372036854775807", "overflowed counters were clobbered")
+
+	rr = app.doReq("POST", "http://domain/incr/"+metaPrefix+"counter", "")
+	assert(t, rr.Code == 400, "incrementing a reserved key should 400: %d", rr.Code)
+
+	// concurrent increments mustn't lose any updates
+	done := make(chan struct{})
+	for i := 0; i < 10; i++ {
+		go func() {
+			for j := 0; j < 20; j++ {
+				app.doReq("POST", "http://domain/incr/concurrent", "")
+			}
+			done <- struct{}{}
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		<-done
+	}
+	assert(t, app.get("concurrent") == "200", "lost concurrent increments: %s", app.get("concurrent"))
+}
+
+func TestExpiry(t *testing.T) {
+	dbpath := setup(t)
+	defer cleanup(dbpath)
+
+	app := newAppTester(t)
+
+	putExpiring := func(key, value string, ttl, at int64) {
+		b := make([]byte, 0)
+		codec.NewEncoderBytes(&b, msgpack).Encode(map[string]interface{}{
+			"key":        key,
+			"value":      value,
+			"ttl":        ttl,
+			"expires_at": at,
+		})
+		rr := app.doReq("POST", "http://domain/key", string(b))
+		assert(t, rr.Code == 204, "bad expiring POST /key response: %d", rr.Code)
+	}
+
+	app.put("plain", "P")
+	putExpiring("live", "L", 3600, 0)
+	putExpiring("dead", "D", 0, 1)
+	rr := app.doReq("PUT", "http://domain/key/rawdead?expires_at=1", "R")
+	assert(t, rr.Code == 204, "bad expiring PUT /key response: %d", rr.Code)
+	app.batch(oplist{
+		{Op: "put", Key: "batchdead", Value: "B", ExpiresAt: 1},
+		{Op: "put", Key: "batchlive", Value: "B", TTL: 3600},
+	})
+
+	assert(t, app.get("live") == "L", "unexpired key missing")
+	for _, key := range []string{"dead", "rawdead", "batchdead"} {
+		found, _ := app.maybeGet(key)
+		assert(t, !found, "expired key %s still visible", key)
+	}
+
+	itemMap := app.multiGet([]string{"live", "dead"})
+	_, found := itemMap["dead"]
+	assert(t, len(itemMap) == 1 && !found, "expired key visible to /keys: %v", itemMap)
+
+	rr = app.doReq("GET", "http://domain/iterate", "")
+	resp := &multiResponse{}
+	app.decode(rr, 200, resp)
+	keys := make([]string, 0)
+	for _, kv := range resp.Data {
+		keys = append(keys, kv.Key)
+	}
+	assert(t, strings.Join(keys, ",") == "batchlive,live,plain", "wrong iterated keys: %v", keys)
+
+	rr = app.doReq("GET", "http://domain/iterate?forward=no", "")
+	resp = &multiResponse{}
+	app.decode(rr, 200, resp)
+	keys = keys[:0]
+	for _, kv := range resp.Data {
+		keys = append(keys, kv.Key)
+	}
+	assert(t, strings.Join(keys, ",") == "plain,live,batchlive", "wrong keys iterated backwards: %v", keys)
+	assert(t, defaultDB.expiring == 5, "wrong # of expiring keys: %d", defaultDB.expiring)
+
+	n, err := defaultDB.reapExpired(time.Now().Unix())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, n == 3, "wrong # of reaped keys: %d", n)
+	assert(t, defaultDB.expiring == 2, "reaping didn't update the # of expiring keys: %d", defaultDB.expiring)
+
+	for _, key := range []string{"dead", "rawdead", "batchdead"} {
+		_, err := defaultDB.db.Get([]byte(key), nil)
+		assert(t, err == leveldb.ErrNotFound, "expired key %s wasn't reaped", key)
+	}
+
+	// a plain overwrite removes the expiry
+	app.put("live", "L2")
+	exp, err := expiryOf(defaultDB.db, []byte("live"))
+	assert(t, err == nil && exp == 0, "overwrite didn't clear expiry: %d", exp)
+	exp, err = expiryOf(defaultDB.db, []byte("batchlive"))
+	assert(t, err == nil && exp > time.Now().Unix(), "lost unexpired expiry: %d", exp)
+	assert(t, defaultDB.expiring == 1, "overwrite didn't update the # of expiring keys: %d", defaultDB.expiring)
+
+	defaultDB.Close()
+	if defaultDB, err = Open(dbpath, Options); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, defaultDB.expiring == 1, "wrong # of expiring keys after reopening: %d", defaultDB.expiring)
+	app = newAppTester(t)
+
+	rr = app.doReq("PUT", "http://domain/key/"+metaPrefix+"ttl/plain", "x")
+	assert(t, rr.Code == 400, "write to the reserved range should 400: %d", rr.Code)
+}
+
+func TestReservedRange(t *testing.T) {
+	dbpath := setup(t)
+	defer cleanup(dbpath)
+
+	app := newAppTester(t)
+
+	// keys either side of the reserved prefix belong to clients, and one of
+	// them has an expiry so there is bookkeeping in between
+	before, after := "\xff\xff\xff\xffa", "\xff\xff\xff\xff\xff"
+	app.put("a", "A")
+	app.put(before, "B")
+	rr := app.doReq("PUT", "http://domain/key/"+url.QueryEscape(after)+"?ttl=3600", "C")
+	assert(t, rr.Code == 204, "bad PUT of a key after the reserved range: %d", rr.Code)
+	assert(t, app.get(after) == "C", "key after the reserved range missing")
+
+	for _, forward := range []string{"yes", "no"} {
+		rr = app.doReq("GET", "http://domain/iterate?forward="+forward, "")
+		resp := &multiResponse{}
+		app.decode(rr, 200, resp)
+		keys := make([]string, 0)
+		for _, kv := range resp.Data {
+			keys = append(keys, kv.Key)
+		}
+		if forward == "no" {
+			for i, j := 0, len(keys)-1; i < j; i, j = i+1, j-1 {
+				keys[i], keys[j] = keys[j], keys[i]
+			}
+		}
+		assert(t, strings.Join(keys, ",") == strings.Join([]string{"a", before, after}, ","), "wrong iterated keys (forward=%s): %q", forward, keys)
+	}
+
+	rr = app.doReq("GET", "http://domain/count?start="+url.QueryEscape(before), "")
+	resp := &struct {
+		Count int `codec:"count"`
+	}{}
+	app.decode(rr, 200, resp)
+	assert(t, resp.Count == 2, "wrong count across the reserved range: %d", resp.Count)
+}
+
+func TestNamedSnapshots(t *testing.T) {
+	dbpath := setup(t)
+	defer cleanup(dbpath)
+
+	app := newAppTester(t)
+	app.put("a", "A")
+	app.put("b", "B")
+
+	rr := app.doReq("POST", "http://domain/snapshots?lease=30", "")
+	snap := &struct {
+		ID    string `codec:"id"`
+		Lease int    `codec:"lease"`
+	}{}
+	app.decode(rr, 200, snap)
+	assert(t, snap.ID != "" && snap.Lease == 30, "bad snapshot response: %v", snap)
+
+	app.put("a", "A2")
+	app.put("c", "C")
+	app.del("b")
+
+	rr = app.doReq("GET", "http://domain/key/a?raw=yes&snapshot="+snap.ID, "")
+	assert(t, rr.Body.String() == "A", "snapshot read saw a later write: %s", rr.Body.String())
+	assert(t, app.get("a") == "A2", "live read didn't see the write")
+
+	rr = app.doReq("GET", "http://domain/iterate?snapshot="+snap.ID, "")
+	resp := &multiResponse{}
+	app.decode(rr, 200, resp)
+	assert(t, len(resp.Data) == 2, "wrong # of keys in snapshot: %d", len(resp.Data))
+	assert(t, resp.Data[1].Key == "b", "deleted key missing from snapshot: %s", resp.Data[1].Key)
+
+	rr = app.doReq("DELETE", "http://domain/snapshots/"+snap.ID, "")
+	assert(t, rr.Code == 204, "bad DELETE /snapshots response: %d", rr.Code)
+	rr = app.doReq("GET", "http://domain/key/a?snapshot="+snap.ID, "")
+	assert(t, rr.Code == 410, "read from a deleted snapshot should 410: %d", rr.Code)
+	rr = app.doReq("DELETE", "http://domain/snapshots/"+snap.ID, "")
+	assert(t, rr.Code == 404, "re-DELETE of a snapshot should 404: %d", rr.Code)
+
+	ls, err := defaultDB.newSnapshot(10 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	_, ok := defaultDB.acquireSnapshot(ls.id)
+	assert(t, !ok, "snapshot outlived its lease")
+}
+
+func TestWatch(t *testing.T) {
+	dbpath := setup(t)
+	defer cleanup(dbpath)
+
+	server := httptest.NewServer(InitRouter(""))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/watch?prefix=user:&values=yes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	ct := resp.Header.Get("Content-Type")
+	assert(t, ct == "text/event-stream", "wrong /watch content-type: %s", ct)
+
+	app := newAppTester(t)
+	app.put("other", "ignored")
+	app.put("user:1", "one")
+	app.batch(oplist{
+		{Op: "put", Key: "user:2", Value: "two"},
+		{Op: "delete", Key: "user:1"},
+	})
+
+	events := bufio.NewReader(resp.Body)
+	next := func() (string, *change) {
+		var event string
+		c := &change{}
+		for {
+			line, err := events.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			line = strings.TrimSpace(line)
+			switch {
+			case line == "":
+				return event, c
+			case strings.HasPrefix(line, "event: "):
+				event = line[len("event: "):]
+			case event == "dropped":
+				c.Value = line[len("data: "):]
+			case strings.HasPrefix(line, "data: "):
+				err := codec.NewDecoderBytes([]byte(line[len("data: "):]), handles[jsonCType]).Decode(c)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+
+	event, c := next()
+	assert(t, event == "put" && c.Key == "user:1" && c.Value == "one", "wrong 1st event: %s %v", event, c)
+	event, c = next()
+	assert(t, event == "put" && c.Key == "user:2" && c.Value == "two", "wrong 2nd event: %s %v", event, c)
+	event, c = next()
+	assert(t, event == "delete" && c.Key == "user:1", "wrong 3rd event: %s %v", event, c)
+
+	// watchers can't follow writes that skip the change log
+	rr := app.doReq("DELETE", "http://domain/range?prefix=user:&log=no", "")
+	assert(t, rr.Code == 200, "bad unlogged DELETE /range response: %d", rr.Code)
+	event, c = next()
+	assert(t, event == "dropped" && c.Value == droppedUnlogged, "wrong event after an unlogged write: %s %v", event, c)
+	_, err = events.ReadString('\n')
+	assert(t, err == io.EOF, "dropped watcher wasn't disconnected: %v", err)
+}
+
+func TestSlowWatcherDropped(t *testing.T) {
+	dbpath := setup(t)
+	defer cleanup(dbpath)
+
+	wt := defaultDB.addWatcher("")
+	defer defaultDB.removeWatcher(wt)
+
+	changes := make([]*change, watchBuffer+1)
+	for i := range changes {
+		changes[i] = &change{Op: "put", Key: fmt.Sprint(i)}
+	}
+	defaultDB.publish(changes)
+
+	var n int
+	for range wt.ch {
+		n++
+	}
+	assert(t, n == watchBuffer, "wrong # of buffered changes before the drop: %d", n)
+	assert(t, wt.dropped == droppedBehind, "wrong reason for the drop: %s", wt.dropped)
+}
+
+func TestChangeLog(t *testing.T) {
+	dbpath := setup(t)
+	defer cleanup(dbpath)
+
+	app := newAppTester(t)
+	app.put("a", "A")
+	app.batch(oplist{
+		{Op: "put", Key: "b", Value: "B", TTL: 60},
+		{Op: "delete", Key: "a"},
+	})
+	app.doReq("POST", "http://domain/incr/n", "")
+
+	type changesResponse struct {
+		Changes []*change `codec:"changes"`
+		Last    uint64    `codec:"last"`
+	}
+	changes := func(query string) *changesResponse {
+		resp := &changesResponse{}
+		app.decode(app.doReq("GET", "http://domain/changes?"+query, ""), 200, resp)
+		return resp
+	}
+
+	resp := changes("")
+	assert(t, resp.Last == 4, "wrong last sequence: %d", resp.Last)
+	assert(t, len(resp.Changes) == 4, "wrong # of changes: %d", len(resp.Changes))
+	for i, c := range resp.Changes {
+		assert(t, c.Seq == uint64(i+1), "wrong sequence number: %d", c.Seq)
+	}
+	assert(t, resp.Changes[0].Op == "put" && resp.Changes[0].Value == "A", "wrong 1st change: %v", resp.Changes[0])
+	assert(t, resp.Changes[1].ExpiresAt > 0, "change lost its expiry: %v", resp.Changes[1])
+	assert(t, resp.Changes[2].Op == "delete" && resp.Changes[2].Key == "a", "wrong 3rd change: %v", resp.Changes[2])
+	assert(t, resp.Changes[1].Txn == 3 && resp.Changes[2].Txn == 3, "batch's changes don't share a txn: %v %v", resp.Changes[1], resp.Changes[2])
+	assert(t, resp.Changes[3].Txn == 4, "lone change isn't its own txn: %v", resp.Changes[3])
+	assert(t, resp.Changes[3].Key == "n" && resp.Changes[3].Value == "1", "wrong 4th change: %v", resp.Changes[3])
+
+	resp = changes("since=2&max=1")
+	assert(t, len(resp.Changes) == 1 && resp.Changes[0].Seq == 3, "wrong paged changes: %v", resp.Changes)
+
+	// the sequence survives a reopen
+	defaultDB.Close()
+	var err error
+	if defaultDB, err = Open(dbpath, Options); err != nil {
+		t.Fatal(err)
+	}
+	app = newAppTester(t)
+	app.put("c", "C")
+	resp = changes("since=4")
+	assert(t, len(resp.Changes) == 1 && resp.Changes[0].Seq == 5, "sequence didn't survive reopen: %v", resp.Changes)
+
+	defer func(count int) { ChangeLogMaxCount = count }(ChangeLogMaxCount)
+	ChangeLogMaxCount = 2
+	n, err := defaultDB.pruneChanges(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, n == 3, "wrong # of pruned changes: %d", n)
+
+	rr := app.doReq("GET", "http://domain/changes?since=2", "")
+	assert(t, rr.Code == 410, "reading pruned changes should 410: %d", rr.Code)
+	resp = changes("since=3")
+	assert(t, len(resp.Changes) == 2, "wrong # of retained changes: %d", len(resp.Changes))
+
+	// bulk writes that skip the log cut it off instead
+	rr = app.doReq("DELETE", "http://domain/range?prefix=c&log=no", "")
+	assert(t, rr.Code == 200, "bad unlogged DELETE /range response: %d", rr.Code)
+	rr = app.doReq("GET", "http://domain/changes?since=5", "")
+	assert(t, rr.Code == 410, "reading from before an unlogged delete should 410: %d", rr.Code)
+	resp = changes("since=6")
+	assert(t, len(resp.Changes) == 0 && resp.Last == 6, "unlogged delete was logged: %v", resp.Changes)
+
+	rr = app.doReqHeaders("POST", "http://domain/import?log=no", "{\"key\":\"d\",\"value\":\"D\"}\n", map[string]string{
+		"Content-Type": "application/x-ndjson",
+	})
+	assert(t, rr.Code == 200, "bad unlogged import response: %d", rr.Code)
+	assert(t, app.get("d") == "D", "unlogged import wasn't written")
+	rr = app.doReq("GET", "http://domain/changes?since=6", "")
+	assert(t, rr.Code == 410, "reading from before an unlogged import should 410: %d", rr.Code)
+
+	// the cut-off survives a reopen, and the old entries are pruned
+	defaultDB.Close()
+	if defaultDB, err = Open(dbpath, Options); err != nil {
+		t.Fatal(err)
+	}
+	app = newAppTester(t)
+	app.put("e", "E")
+	resp = changes("since=7")
+	assert(t, len(resp.Changes) == 1 && resp.Changes[0].Seq == 8, "sequence didn't survive reopen: %v", resp.Changes)
+
+	n, err = defaultDB.pruneChanges(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, n == 2, "wrong # of changes pruned from before the cut-off: %d", n)
+}
+
+func TestReplicationStreams(t *testing.T) {
+	dbpath := setup(t)
+	defer cleanup(dbpath)
+
+	app := newAppTester(t)
+	app.put("a", "A")
+	app.put("b", "B")
+
+	rr := app.doReq("GET", "http://domain/replication/bootstrap", "")
+	assert(t, rr.Code == 200, "bad bootstrap response: %d", rr.Code)
+	dec := codec.NewDecoder(rr.Body, msgpack)
+	var records []*change
+	for {
+		c := &change{}
+		if err := dec.Decode(c); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, c)
+	}
+	assert(t, len(records) == 4, "wrong # of bootstrap records: %d", len(records))
+	assert(t, records[0].Op == "bootstrap" && records[0].Seq == 2, "bad bootstrap header: %v", records[0])
+	assert(t, records[2].Key == "b" && records[2].Value == "B", "bad bootstrap record: %v", records[2])
+	assert(t, records[3].Op == "end" && records[3].Seq == 2, "bad bootstrap trailer: %v", records[3])
+
+	server := httptest.NewServer(InitRouter(""))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/replication/stream?since=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	assert(t, resp.StatusCode == 200, "bad replication stream response: %d", resp.StatusCode)
+
+	app.del("a")
+
+	dec = codec.NewDecoder(resp.Body, msgpack)
+	for _, want := range []*change{{Seq: 2, Op: "put", Key: "b"}, {Seq: 3, Op: "delete", Key: "a"}} {
+		c := &change{}
+		if err := dec.Decode(c); err != nil {
+			t.Fatal(err)
+		}
+		assert(t, c.Seq == want.Seq && c.Op == want.Op && c.Key == want.Key, "wrong replicated change: %v", c)
+	}
+
+	rr = app.doReq("GET", "http://domain/replication/stream?since=x", "")
+	assert(t, rr.Code == 400, "bad since should 400: %d", rr.Code)
+}
+
+func TestFollow(t *testing.T) {
+	dbpath := setup(t)
+	defer cleanup(dbpath)
+
+	app := newAppTester(t)
+	app.put("stale", "gone after bootstrap")
+
+	// never having finished a bootstrap, the data can't be trusted even
+	// without reaching the primary
+	defaultDB.Follow("http://127.0.0.1:1")
+	rr := app.doReq("GET", "http://domain/key/stale", "")
+	assert(t, rr.Code == 503, "unbootstrapped follower served a read: %d", rr.Code)
+	assert(t, defaultDB.followStatus().Bootstrap, "status doesn't show the unfinished bootstrap")
+	defaultDB.stopFollowing()
+
+	// a stand-in primary which sends a fixed bootstrap and stream, pausing
+	// the bootstrap partway through until released
+	release := make(chan struct{})
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		enc := codec.NewEncoder(w, msgpack)
+		switch r.URL.Path {
+		case "/replication/bootstrap":
+			enc.Encode(&change{Op: "bootstrap", Seq: 5})
+			enc.Encode(&change{Op: "put", Key: "a", Value: "A"})
+			w.(http.Flusher).Flush()
+			<-release
+			enc.Encode(&change{Op: "put", Key: "b", Value: "B"})
+			enc.Encode(&change{Op: "end", Seq: 5})
+		case "/replication/stream":
+			assert(t, r.URL.Query().Get("since") == "5", "wrong stream position: %s", r.URL.RawQuery)
+			enc.Encode(&change{Seq: 6, Op: "put", Key: "c", Value: "C"})
+			enc.Encode(&change{Seq: 7, Op: "delete", Key: "a", Txn: 8})
+			enc.Encode(&change{Seq: 8, Op: "put", Key: "e", Value: "E", Txn: 8})
+			// a txn that never finishes arriving
+			enc.Encode(&change{Seq: 9, Op: "put", Key: "f", Value: "F", Txn: 10})
+			enc.Encode(&change{Op: "heartbeat", Seq: 10})
+			w.(http.Flusher).Flush()
+			<-w.(http.CloseNotifier).CloseNotify()
+		}
+	}))
+	defer primary.Close()
+
+	defaultDB.Follow(primary.URL)
+	defer defaultDB.stopFollowing()
+
+	// reads are unavailable while the data is half loaded
+	deadline := time.Now().Add(5 * time.Second)
+	for app.doReq("GET", "http://domain/key/stale", "").Code != 503 {
+		if time.Now().After(deadline) {
+			t.Fatal("reads weren't refused during the bootstrap")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert(t, defaultDB.followStatus().Bootstrap, "status doesn't show the bootstrap")
+	close(release)
+
+	for defaultDB.followStatus().PrimaryLast < 10 {
+		if time.Now().After(deadline) {
+			t.Fatalf("follower didn't catch up: %+v", defaultDB.followStatus())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	st := defaultDB.followStatus()
+	assert(t, st.Role == "follower" && st.Connected, "bad follower status: %+v", st)
+	assert(t, st.Applied == 8 && st.Lag == 2, "wrong replication lag: %+v", st)
+
+	found, _ := app.maybeGet("stale")
+	assert(t, !found, "bootstrap should have cleared existing keys")
+	found, _ = app.maybeGet("a")
+	assert(t, !found, "replicated delete wasn't applied")
+	assert(t, app.get("b") == "B", "bootstrapped key missing")
+	assert(t, app.get("c") == "C", "replicated put wasn't applied")
+	assert(t, app.get("e") == "E", "replicated txn wasn't applied")
+	found, _ = app.maybeGet("f")
+	assert(t, !found, "part of a txn was applied")
+
+	rr = app.doReq("PUT", "http://domain/key/d", "D")
+	assert(t, rr.Code == 403, "follower should refuse writes: %d", rr.Code)
+
+	applied, ok, err := defaultDB.loadApplied()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, ok && applied == 8, "applied sequence wasn't stored: %d", applied)
+
+	// the bootstrap cut off the change log, and only the stream's changes
+	// were logged after it
+	rr = app.doReq("GET", "http://domain/changes?since=0", "")
+	gone := &struct {
+		First uint64 `codec:"first"`
+	}{}
+	app.decode(rr, 410, gone)
+	rr = app.doReq("GET", fmt.Sprintf("http://domain/changes?since=%d", gone.First-1), "")
+	resp := &struct {
+		Changes []*change `codec:"changes"`
+	}{}
+	app.decode(rr, 200, resp)
+	assert(t, len(resp.Changes) == 3 && resp.Changes[0].Key == "c" && resp.Changes[1].Key == "a", "bootstrap was logged: %v", resp.Changes)
+	assert(t, resp.Changes[1].Txn == resp.Changes[2].Seq, "replicated txn wasn't logged together: %v", resp.Changes[1])
+}
+
+func TestPrimaryFollower(t *testing.T) {
+	var dbs [2]*Database
+	var apps [2]*appTester
+	for i := range dbs {
+		dirpath, err := ioutil.TempDir("", "ldbrest_test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dirpath)
+
+		if dbs[i], err = Open(dirpath, Options); err != nil {
+			t.Fatal(err)
+		}
+		defer dbs[i].Close()
+
+		router := NewRouter()
+		dbs[i].AddRoutes(router, "")
+		apps[i] = &appTester{app: router, tb: t}
+	}
+	primary, follower := apps[0], apps[1]
+
+	primary.put("a", "A")
+	primary.put("b", "B")
+	primary.put("c", "C")
+	primary.del("b")
+
+	server := httptest.NewServer(primary.app)
+	defer server.Close()
+
+	// once the follower has the primary's latest change, it should have the
+	// same data
+	caughtUp := func() {
+		last := atomic.LoadUint64(&dbs[0].lastSeq)
+		deadline := time.Now().Add(5 * time.Second)
+		for st := dbs[1].followStatus(); st.Applied < last; st = dbs[1].followStatus() {
+			if time.Now().After(deadline) {
+				t.Fatalf("follower didn't catch up to %d: %+v", last, st)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	dbs[1].Follow(server.URL)
+	defer dbs[1].stopFollowing()
+	caughtUp()
+	assert(t, follower.get("a") == "A", "bootstrap missed a key")
+	assert(t, follower.get("c") == "C", "bootstrap missed a key")
+	found, _ := follower.maybeGet("b")
+	assert(t, !found, "bootstrap copied a deleted key")
+
+	// and later writes are streamed over
+	primary.put("d", "D")
+	primary.del("a")
+	assert(t, primary.batch(oplist{
+		{Op: "put", Key: "e", Value: "E"},
+		{Op: "delete", Key: "c"},
+	}), "batch on the primary failed")
+	caughtUp()
+
+	assert(t, follower.get("d") == "D", "streamed put wasn't applied")
+	assert(t, follower.get("e") == "E", "streamed batch put wasn't applied")
+	for _, key := range []string{"a", "b", "c"} {
+		found, _ := follower.maybeGet(key)
+		assert(t, !found, "key %s should have been deleted", key)
+	}
+
+	st := dbs[1].followStatus()
+	assert(t, st.Connected && !st.Bootstrap && st.Lag == 0, "bad follower status: %+v", st)
+
+	rr := follower.doReq("PUT", "http://domain/key/f", "F")
+	assert(t, rr.Code == 403, "follower should refuse writes: %d", rr.Code)
+}
+
+func TestSnapshotCopies(t *testing.T) {
+	dbpath := setup(t)
+	defer cleanup(dbpath)
+
+	app := newAppTester(t)
+	for i := 0; i < 100; i++ {
+		app.put(fmt.Sprintf("flushed%03d", i), "value")
+	}
+	// get some keys into a table file, and leave some in the journal
+	if err := defaultDB.db.CompactRange(util.Range{}); err != nil {
+		t.Fatal(err)
+	}
+	app.put("journaled", "J")
+
+	dest, err := ioutil.TempDir("", "ldbrest_snap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+
+	snapshot := func(destpath, mode string) int {
+		b := make([]byte, 0)
+		codec.NewEncoderBytes(&b, msgpack).Encode(map[string]string{
+			"destination": destpath,
+			"mode":        mode,
+		})
+		return app.doReq("POST", "http://domain/snapshot", string(b)).Code
+	}
+
+	for _, mode := range []string{"checkpoint", "logical"} {
+		destpath := filepath.Join(dest, mode)
+		code := snapshot(destpath, mode)
+		assert(t, code == 204, "bad %s POST /snapshot response: %d", mode, code)
+
+		copied, err := leveldb.OpenFile(destpath, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range []string{"flushed000", "flushed099", "journaled"} {
+			_, err := copied.Get([]byte(key), nil)
+			assert(t, err == nil, "%s copy is missing %s: %v", mode, key, err)
+		}
+		copied.Close()
+	}
+
+	// the checkpoint's tables are the very same files
+	tables, _ := filepath.Glob(filepath.Join(dbpath, "*.ldb"))
+	assert(t, len(tables) > 0, "compaction didn't produce a table file")
+	var linked bool
+	for _, table := range tables {
+		orig, _ := os.Stat(table)
+		if fi, err := os.Stat(filepath.Join(dest, "checkpoint", filepath.Base(table))); err == nil && os.SameFile(orig, fi) {
+			linked = true
+		}
+	}
+	assert(t, linked, "checkpoint didn't hard-link table files")
+
+	// while a checkpoint holds the storage, compactions don't remove tables
+	defaultDB.stor.hold()
+	for i := 0; i < 100; i++ {
+		app.put(fmt.Sprintf("flushed%03d", i), "rewritten")
+	}
+	if err := defaultDB.db.CompactRange(util.Range{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range tables {
+		_, err := os.Stat(table)
+		assert(t, err == nil, "table removed during a hold: %v", err)
+	}
+	defaultDB.stor.release()
+	for _, table := range tables {
+		_, err := os.Stat(table)
+		assert(t, os.IsNotExist(err), "held off table wasn't removed on release: %s", table)
+	}
+
+	code := snapshot(filepath.Join(dest, "other"), "bogus")
+	assert(t, code == 400, "bad mode should 400: %d", code)
+
+	// an existing destination is refused, and left alone
+	existing := filepath.Join(dest, "existing")
+	os.Mkdir(existing, 0755)
+	ioutil.WriteFile(filepath.Join(existing, "keep"), []byte("mine"), 0644)
+	for _, mode := range []string{"checkpoint", "logical"} {
+		code = snapshot(existing, mode)
+		assert(t, code == 500, "%s snapshot over an existing directory should fail: %d", mode, code)
+		_, err := os.Stat(filepath.Join(existing, "keep"))
+		assert(t, err == nil, "%s snapshot disturbed an existing directory: %v", mode, err)
+	}
+}
+
+func TestSnapshotTar(t *testing.T) {
+	dbpath := setup(t)
+	defer cleanup(dbpath)
+
+	app := newAppTester(t)
+	app.put("a", "A")
+	// one key in a table file, and one in the journal
+	if err := defaultDB.db.CompactRange(util.Range{}); err != nil {
+		t.Fatal(err)
+	}
+	app.put("b", "B")
+
+	// a table the manifest doesn't refer to, as though a compaction were
+	// still writing it
+	if err := ioutil.WriteFile(filepath.Join(dbpath, "999999.ldb"), []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	dest, err := ioutil.TempDir("", "ldbrest_untar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+
+	rr := app.doReq("GET", "http://domain/snapshot.tar?gzip=yes", "")
+	assert(t, rr.Code == 200, "bad GET /snapshot.tar response: %d", rr.Code)
+	assert(t, rr.HeaderMap.Get("Content-Type") == "application/gzip", "wrong content-type: %s", rr.HeaderMap.Get("Content-Type"))
+
+	zr, err := gzip.NewReader(rr.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		assert(t, hdr.Name != "999999.ldb", "tarball has a table the manifest doesn't refer to")
+		f, err := os.Create(filepath.Join(dest, hdr.Name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = io.Copy(f, tr)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	restored, err := leveldb.OpenFile(dest, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	value, err := restored.Get([]byte("a"), nil)
+	assert(t, err == nil && string(value) == "A", "restored tarball is missing a: %v", err)
+	value, err = restored.Get([]byte("b"), nil)
+	assert(t, err == nil && string(value) == "B", "restored tarball is missing b: %v", err)
+}
+
+func TestImport(t *testing.T) {
+	dbpath := setup(t)
+	defer cleanup(dbpath)
+
+	app := newAppTester(t)
+	app.put("k1500", "existing")
+
+	b := make([]byte, 0)
+	enc := codec.NewEncoderBytes(&b, msgpack)
+	for i := 0; i < 2500; i++ {
+		enc.Encode(&importRecord{Key: fmt.Sprintf("k%04d", i), Value: "imported"})
+	}
+
+	res := &importResult{}
+	app.decode(app.doReq("POST", "http://domain/import?existing=reject", string(b)), 409, res)
+	assert(t, res.Imported == 1500 && res.Offset != nil && *res.Offset == 1500, "wrong rejected import result: %+v", res)
+	assert(t, app.get("k1499") == "imported", "records before the rejected one weren't imported")
+	found, _ := app.maybeGet("k1501")
+	assert(t, !found, "records after the rejected one were imported")
+
+	res = &importResult{}
+	app.decode(app.doReq("POST", "http://domain/import?existing=skip", string(b)), 200, res)
+	assert(t, res.Imported == 999 && res.Skipped == 1501, "wrong skipping import result: %+v", res)
+	assert(t, app.get("k1500") == "existing", "skipping import overwrote a key")
+
+	rr := app.doReqHeaders("POST", "http://domain/import", "{\"key\":\"k1500\",\"value\":\"over\"}\n{\"key\":\"n\",\"value\":\"N\",\"ttl\":60}\n", map[string]string{
+		"Content-Type": "application/x-ndjson",
+	})
+	res = &importResult{}
+	app.decode(rr, 200, res)
+	assert(t, res.Imported == 2, "wrong NDJSON import result: %+v", res)
+	assert(t, app.get("k1500") == "over", "import didn't overwrite a key")
+	expires, _ := expiryOf(defaultDB.db, []byte("n"))
+	assert(t, expires > 0, "import lost the ttl")
+
+	// a stream cut off mid-record
+	res = &importResult{}
+	app.decode(app.doReq("POST", "http://domain/import", string(b[:len(b)-3])), 400, res)
+	assert(t, res.Imported == 2499 && *res.Offset == 2499, "wrong truncated import result: %+v", res)
+
+	rr = app.doReq("POST", "http://domain/import?existing=bogus", string(b))
+	assert(t, rr.Code == 400, "bad import mode should 400: %d", rr.Code)
+}
+
+func TestExport(t *testing.T) {
+	dbpath := setup(t)
+	defer cleanup(dbpath)
+
+	app := newAppTester(t)
+	app.put("x/a", "A")
+	app.put("x/b", "Bravo")
+	app.put("y", "Y")
+	app.doReq("PUT", "http://domain/key/x/c?ttl=60", "C")
+
+	rr := app.doReq("GET", "http://domain/export?prefix=x/", "")
+	assert(t, rr.Code == 200, "bad GET /export response: %d", rr.Code)
+	export := rr.Body.String()
+
+	dec := codec.NewDecoder(strings.NewReader(export), msgpack)
+	header := &exportHeader{}
+	if err := dec.Decode(header); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, header.Format == exportFormat && header.Version == exportVersion, "bad export header: %+v", header)
+	var recs []*importRecord
+	for i := 0; i < 3; i++ {
+		rec := &importRecord{}
+		if err := dec.Decode(rec); err != nil {
+			t.Fatal(err)
+		}
+		recs = append(recs, rec)
+	}
+	assert(t, recs[2].Key == "x/c" && recs[2].ExpiresAt > 0, "bad export record: %+v", recs[2])
+	assert(t, recs[0].CRC != nil && *recs[0].CRC == recordChecksum("x/a", "A", 0), "bad export checksum: %+v", recs[0])
+	trailer := &exportTrailer{}
+	if err := dec.Decode(trailer); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, trailer.Count == 3, "wrong export trailer count: %d", trailer.Count)
+
+	// it round-trips through an import
+	app.doReq("DELETE", "http://domain/range?prefix=x/", "")
+	rr = app.doReq("POST", "http://domain/import", export)
+	assert(t, rr.Code == 200, "bad import of an export: %d", rr.Code)
+	assert(t, app.get("x/b") == "Bravo", "export didn't import")
+	expires, _ := expiryOf(defaultDB.db, []byte("x/c"))
+	assert(t, expires == recs[2].ExpiresAt, "import of an export lost the expiry")
+
+	// tampering with a record, or losing the trailer, gets caught
+	rr = app.doReq("POST", "http://domain/import", strings.Replace(export, "Bravo", "Brave", 1))
+	assert(t, rr.Code == 400, "import of a corrupt export should 400: %d", rr.Code)
+	res := &importResult{}
+	app.decode(app.doReq("POST", "http://domain/import", export[:len(export)-len("\x81\xa5count\x03")]), 400, res)
+	assert(t, res.Error == errExportTrunc.Error() && res.Imported == 3, "wrong truncated export import result: %+v", res)
+}
+
+func TestCompact(t *testing.T) {
+	dbpath := setup(t)
+	defer cleanup(dbpath)
+
+	app := newAppTester(t)
+	for i := 0; i < 1000; i++ {
+		app.put(fmt.Sprintf("k%04d", i), strings.Repeat("v", 100))
+	}
+	if err := defaultDB.db.CompactRange(util.Range{}); err != nil {
+		t.Fatal(err)
+	}
+	app.doReq("DELETE", "http://domain/range?prefix=k", "")
+
+	// the change log is holding on to all that too
+	defer func(count int) { ChangeLogMaxCount = count }(ChangeLogMaxCount)
+	ChangeLogMaxCount = 1
+	if _, err := defaultDB.pruneChanges(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	waitCompaction := func() *compactState {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			st := &compactState{}
+			app.decode(app.doReq("GET", "http://domain/compact", ""), 200, st)
+			if !st.Running {
+				return st
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("compaction didn't finish")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	st := &compactState{}
+	app.decode(app.doReq("POST", "http://domain/compact", ""), 202, st)
+	assert(t, st.Started > 0 && st.SizeBefore > 0, "bad compaction status: %+v", st)
+
+	st = waitCompaction()
+	assert(t, st.Finished > 0 && st.Error == "", "bad finished compaction status: %+v", st)
+	assert(t, st.Size < st.SizeBefore, "compaction didn't reclaim space: %+v", st)
+
+	st = &compactState{}
+	app.decode(app.doReq("POST", "http://domain/compact?prefix=k", ""), 202, st)
+	assert(t, st.Start == "k", "ranged compaction has the wrong start")
+	waitCompaction()
+}
+
+func TestSizes(t *testing.T) {
+	dbpath := setup(t)
+	defer cleanup(dbpath)
+
+	app := newAppTester(t)
+	rnd := rand.New(rand.NewSource(1))
+	value := func(n int) string {
+		b := make([]byte, n)
+		for i := range b {
+			b[i] = byte(rnd.Intn(256))
+		}
+		return string(b)
+	}
+	for i := 0; i < 500; i++ {
+		app.put(fmt.Sprintf("users/%03d", i), value(1000))
+	}
+	for i := 0; i < 100; i++ {
+		app.put(fmt.Sprintf("logs/%03d", i), value(1000))
+	}
+	app.put("solo", value(1000))
+	if err := defaultDB.db.CompactRange(util.Range{}); err != nil {
+		t.Fatal(err)
+	}
+
+	sizes := func(req interface{}) []*sizeRange {
+		b := make([]byte, 0)
+		codec.NewEncoderBytes(&b, msgpack).Encode(req)
+		resp := &struct {
+			Data []*sizeRange `codec:"data"`
+		}{}
+		app.decode(app.doReq("POST", "http://domain/sizes", string(b)), 200, resp)
+		return resp.Data
+	}
+
+	data := sizes(map[string]interface{}{
+		"ranges": []*sizeRange{{Prefix: "users/"}, {Prefix: "logs/"}, {Start: "a", End: "b"}},
+	})
+	assert(t, len(data) == 3, "wrong # of sizes: %d", len(data))
+	assert(t, data[0].Size > data[1].Size && data[1].Size > 0, "wrong prefix sizes: %d, %d", data[0].Size, data[1].Size)
+	assert(t, data[2].Size == 0, "empty range has a size: %d", data[2].Size)
+
+	data = sizes(map[string]interface{}{"delimiter": "/", "top": 2})
+	assert(t, len(data) == 2, "wrong # of top prefixes: %d", len(data))
+	assert(t, data[0].Prefix == "users/" && data[1].Prefix == "logs/", "wrong top prefixes: %s, %s", data[0].Prefix, data[1].Prefix)
+
+	data = sizes(map[string]interface{}{"delimiter": "/", "prefix": "users/0"})
+	assert(t, len(data) == 10, "wrong # of nested top prefixes: %d", len(data))
+}
+
+func TestOptions(t *testing.T) {
+	dbpath := setup(t)
+	defer cleanup(dbpath)
+
+	defer func(o DBOptions) { Options = o }(Options)
+
+	f, err := ioutil.TempFile("", "ldbrest_options")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`{"block_cache_size": 16777216, "compression": "none", "bloom_filter_bits": 10}`)
+	f.Close()
+
+	if Options, err = LoadOptions(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, Options.Validate() == nil, "valid options failed validation")
+	lo := Options.leveldb()
+	assert(t, lo.BlockCacheCapacity == 16*opt.MiB && lo.Compression == opt.NoCompression && lo.Filter != nil, "wrong leveldb options: %+v", lo)
+
+	// as though the db had been opened with them
+	defaultDB.options = Options
+	app := newAppTester(t)
+	rr := app.doReqHeaders("GET", "http://domain/options", "", map[string]string{
+		"Accept": "application/json",
+	})
+	eff := &DBOptions{}
+	app.decode(rr, 200, eff)
+	assert(t, eff.BlockCacheSize == 16*opt.MiB && eff.Compression == "none", "wrong effective options: %+v", eff)
+	assert(t, eff.WriteBuffer == opt.DefaultWriteBuffer && eff.Strict == "default", "effective options lack defaults: %+v", eff)
+
+	for _, bad := range []DBOptions{{WriteBuffer: -1}, {Compression: "zlib"}, {Strict: "very"}} {
+		assert(t, bad.Validate() != nil, "invalid options passed validation: %+v", bad)
+	}
+
+	ioutil.WriteFile(f.Name(), []byte(`{"block_cach_size": 1}`), 0644)
+	_, err = LoadOptions(f.Name())
+	assert(t, err != nil, "misspelled option was accepted")
+}
+
+func TestAuth(t *testing.T) {
+	dbpath := setup(t)
+	defer cleanup(dbpath)
+
+	defer func() { AuthTokens, ReadTokens = nil, nil }()
+	AuthTokens = []string{"full"}
+	ReadTokens = []string{"peek"}
+
+	app := newAppTester(t)
+	req := func(method, url, body, token string) int {
+		headers := map[string]string{}
+		if token != "" {
+			headers["Authorization"] = "Bearer " + token
+		}
+		return app.doReqHeaders(method, url, body, headers).Code
+	}
+
+	code := req("PUT", "http://domain/key/a", "A", "")
+	assert(t, code == 401, "write without a token should 401: %d", code)
+	code = req("PUT", "http://domain/key/a", "A", "wrong")
+	assert(t, code == 401, "write with a bad token should 401: %d", code)
+	code = req("PUT", "http://domain/key/a", "A", "peek")
+	assert(t, code == 403, "write with a read token should 403: %d", code)
+	code = req("PUT", "http://domain/key/a", "A", "full")
+	assert(t, code == 204, "write with a full token failed: %d", code)
+
+	code = req("GET", "http://domain/key/a", "", "")
+	assert(t, code == 401, "read without a token should 401: %d", code)
+	code = req("GET", "http://domain/key/a", "", "peek")
+	assert(t, code == 200, "read with a read token failed: %d", code)
+	code = req("POST", "http://domain/compact", "", "peek")
+	assert(t, code == 403, "compaction with a read token should 403: %d", code)
+}
+
+func TestMultipleDatabases(t *testing.T) {
+	router := NewRouter()
+	for i, name := range []string{"a", "b"} {
+		dirpath, err := ioutil.TempDir("", "ldbrest_test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dirpath)
+
+		d, err := Open(dirpath, DBOptions{BlockSize: (i + 1) * 8192})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer d.Close()
+		d.AddRoutes(router, "/db/"+name)
+	}
+	app := &appTester{app: router, tb: t}
+
+	rr := app.doReq("PUT", "http://domain/db/a/key/k", "A")
+	assert(t, rr.Code == 204, "bad PUT to db a: %d", rr.Code)
+	rr = app.doReq("GET", "http://domain/db/a/key/k?raw=yes", "")
+	assert(t, rr.Code == 200 && rr.Body.String() == "A", "db a lost its key: %d %s", rr.Code, rr.Body.String())
+	rr = app.doReq("GET", "http://domain/db/b/key/k", "")
+	assert(t, rr.Code == 404, "db a's key showed up in db b: %d", rr.Code)
+	rr = app.doReq("GET", "http://domain/key/k", "")
+	assert(t, rr.Code == 404, "nothing should be served at the root: %d", rr.Code)
+
+	rr = app.doReqHeaders("GET", "http://domain/db/b/options", "", map[string]string{
+		"Accept": "application/json",
+	})
+	eff := &DBOptions{}
+	app.decode(rr, 200, eff)
+	assert(t, eff.BlockSize == 16384, "db b has the wrong options: %+v", eff)
+
+	rr = app.doReq("GET", "http://domain/db/b/property/leveldb.stats", "")
+	assert(t, rr.Code == 200, "bad property response from db b: %d", rr.Code)
+
+	rr = app.doReq("POST", "http://domain/db/a/snapshots", "")
+	snap := &struct {
+		ID string `codec:"id"`
+	}{}
+	app.decode(rr, 200, snap)
+	rr = app.doReq("GET", "http://domain/db/a/key/k?snapshot="+snap.ID, "")
+	assert(t, rr.Code == 200, "read from db a's snapshot failed: %d", rr.Code)
+	rr = app.doReq("GET", "http://domain/db/b/key/k?snapshot="+snap.ID, "")
+	assert(t, rr.Code == 410, "db a's snapshot should be unknown to db b: %d", rr.Code)
+}
+
 func setup(tb testing.TB) string {
 	dirpath, err := ioutil.TempDir("", "ldbrest_test")
 	if err != nil {
 		tb.Fatal(err)
 	}
 
-	db, err = leveldb.OpenFile(dirpath, &opt.Options{
-		ErrorIfExist: true,
-	})
-	if err != nil {
+	if defaultDB, err = Open(dirpath, Options); err != nil {
 		os.RemoveAll(dirpath)
 		tb.Fatal(err)
 	}
@@ -240,8 +1788,9 @@ func setup(tb testing.TB) string {
 }
 
 func cleanup(path string) {
-	if db != nil {
-		db.Close()
+	if defaultDB != nil {
+		defaultDB.Close()
+		defaultDB = nil
 	}
 	os.RemoveAll(path)
 }
@@ -261,7 +1810,26 @@ func newAppTester(tb testing.TB) *appTester {
 	return &appTester{app: InitRouter(""), tb: tb}
 }
 
+// decode checks a response's status, and decodes its body into v according to
+// its Content-Type
+func (app *appTester) decode(rr *httptest.ResponseRecorder, code int, v interface{}) {
+	if rr.Code != code {
+		app.tb.Fatalf("bad response status: %d (wanted %d)", rr.Code, code)
+	}
+	h, ok := handles[rr.HeaderMap.Get("Content-Type")]
+	if !ok {
+		app.tb.Fatalf("undecodable response content type: %s", rr.HeaderMap.Get("Content-Type"))
+	}
+	if err := codec.NewDecoder(rr.Body, h).Decode(v); err != nil {
+		app.tb.Fatal(err)
+	}
+}
+
 func (app *appTester) doReq(method, url, body string) *httptest.ResponseRecorder {
+	return app.doReqHeaders(method, url, body, nil)
+}
+
+func (app *appTester) doReqHeaders(method, url, body string, headers map[string]string) *httptest.ResponseRecorder {
 	var bodyReader io.Reader
 	if body == "" {
 		bodyReader = nil
@@ -272,6 +1840,9 @@ func (app *appTester) doReq(method, url, body string) *httptest.ResponseRecorder
 	if err != nil {
 		app.tb.Fatal(err)
 	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
 
 	rr := httptest.NewRecorder()
 	app.app.ServeHTTP(rr, req)
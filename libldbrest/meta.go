@@ -0,0 +1,108 @@
+package libldbrest
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/comparer"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// ldbrest keeps its own bookkeeping in the same leveldb as the data, under a
+// reserved prefix that no reasonable key starts with. Keys with that prefix
+// are hidden from clients and can't be written by them.
+const metaPrefix = "\xff\xff\xff\xffldbrest:"
+
+var (
+	errReservedKey = errors.New("key is in ldbrest's reserved range")
+
+	metaRange = util.BytesPrefix([]byte(metaPrefix))
+)
+
+func isReserved(key []byte) bool {
+	return bytes.HasPrefix(key, []byte(metaPrefix))
+}
+
+// userRanges splits an iterator range (nil meaning everything) into the parts
+// either side of the reserved range, leaving out any that are empty.
+func userRanges(slice *util.Range) []util.Range {
+	if slice == nil {
+		slice = &util.Range{}
+	}
+
+	var rngs []util.Range
+	if bytes.Compare(slice.Start, metaRange.Start) < 0 {
+		rng := util.Range{Start: slice.Start, Limit: metaRange.Start}
+		if slice.Limit != nil && bytes.Compare(slice.Limit, rng.Limit) < 0 {
+			rng.Limit = slice.Limit
+		}
+		rngs = append(rngs, rng)
+	}
+	if slice.Limit == nil || bytes.Compare(slice.Limit, metaRange.Limit) > 0 {
+		rng := util.Range{Start: metaRange.Limit, Limit: slice.Limit}
+		if bytes.Compare(slice.Start, rng.Start) > 0 {
+			rng.Start = slice.Start
+		}
+		rngs = append(rngs, rng)
+	}
+	return rngs
+}
+
+// newUserIterator iterates over the keys in slice (nil meaning everything)
+// other than those in the reserved range
+func newUserIterator(src reader, slice *util.Range, ro *opt.ReadOptions) iterator.Iterator {
+	rngs := userRanges(slice)
+	switch len(rngs) {
+	case 0:
+		return iterator.NewEmptyIterator(nil)
+	case 1:
+		return src.NewIterator(&rngs[0], ro)
+	}
+
+	iters := make([]iterator.Iterator, len(rngs))
+	for i := range rngs {
+		iters[i] = src.NewIterator(&rngs[i], ro)
+	}
+	return iterator.NewMergedIterator(iters, comparer.DefaultComparer, true)
+}
+
+// userSizeOf is db.SizeOf, leaving out the reserved range
+func userSizeOf(db *leveldb.DB, rngs []util.Range) ([]uint64, error) {
+	var (
+		parts []util.Range
+		owner []int
+	)
+	for i := range rngs {
+		for _, rng := range userRanges(&rngs[i]) {
+			parts = append(parts, rng)
+			owner = append(owner, i)
+		}
+	}
+
+	sizes := make([]uint64, len(rngs))
+	if len(parts) == 0 {
+		return sizes, nil
+	}
+	partSizes, err := db.SizeOf(parts)
+	if err != nil {
+		return nil, err
+	}
+	for i, size := range partSizes {
+		sizes[owner[i]] += size
+	}
+	return sizes, nil
+}
+
+// metaKey builds a key in the reserved range out of a section name
+// (like "ttl") and any further parts
+func metaKey(section string, parts ...[]byte) []byte {
+	key := append([]byte(metaPrefix), section...)
+	key = append(key, '/')
+	for _, part := range parts {
+		key = append(key, part...)
+	}
+	return key
+}
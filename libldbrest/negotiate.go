@@ -0,0 +1,171 @@
+package libldbrest
+
+import (
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/ugorji/go/codec"
+)
+
+// the serialization formats we can speak, keyed by their content-type
+var handles = map[string]codec.Handle{
+	msgpackCType: msgpack,
+	jsonCType:    &codec.JsonHandle{},
+	cborCType:    &codec.CborHandle{},
+	bincCType:    &codec.BincHandle{},
+}
+
+// requestHandle picks the codec for a request body based on its
+// Content-Type header, defaulting to msgpack if there isn't one.
+func requestHandle(r *http.Request) (codec.Handle, bool) {
+	ct := r.Header.Get("Content-Type")
+	if ct == "" {
+		return msgpack, true
+	}
+
+	mt, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return nil, false
+	}
+
+	h, ok := handles[mt]
+	return h, ok
+}
+
+// responseHandle picks the content-type and codec for a response body based
+// on the request's Accept header, defaulting to msgpack if there isn't one
+// or it allows anything.
+func responseHandle(r *http.Request) (string, codec.Handle, bool) {
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return msgpackCType, msgpack, true
+	}
+
+	for _, mt := range acceptedTypes(accept) {
+		switch mt {
+		case "*/*", "application/*":
+			return msgpackCType, msgpack, true
+		}
+		if h, ok := handles[mt]; ok {
+			return mt, h, true
+		}
+	}
+
+	return "", nil, false
+}
+
+// wantsRaw reports whether the client asked for a bare value rather than an
+// encoded key/value object, either with the "raw=yes" query parameter or by
+// preferring application/octet-stream in its Accept header.
+func wantsRaw(r *http.Request) bool {
+	if r.URL.Query().Get("raw") == "yes" {
+		return true
+	}
+
+	for _, mt := range acceptedTypes(r.Header.Get("Accept")) {
+		if mt == rawCType {
+			return true
+		}
+		if _, ok := handles[mt]; ok || mt == "*/*" || mt == "application/*" {
+			return false
+		}
+	}
+	return false
+}
+
+type mediaRange struct {
+	mtype string
+	q     float64
+}
+
+type byQuality []mediaRange
+
+func (b byQuality) Len() int           { return len(b) }
+func (b byQuality) Less(i, j int) bool { return b[i].q > b[j].q }
+func (b byQuality) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// acceptedTypes parses an Accept header into its media types, most preferred
+// first. Types given a zero quality are left out entirely.
+func acceptedTypes(accept string) []string {
+	ranges := make([]mediaRange, 0)
+	for _, part := range strings.Split(accept, ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+		if qs, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(qs, 64); err != nil {
+				continue
+			}
+		}
+		if q <= 0 {
+			continue
+		}
+
+		ranges = append(ranges, mediaRange{mt, q})
+	}
+
+	// stable so that equal qualities keep the client's ordering
+	sort.Stable(byQuality(ranges))
+
+	types := make([]string, len(ranges))
+	for i, mr := range ranges {
+		types[i] = mr.mtype
+	}
+	return types
+}
+
+// decodeRequest decodes the request body into v using the codec named by the
+// Content-Type. It writes the failure response itself and returns false if
+// that wasn't possible.
+func decodeRequest(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	h, ok := requestHandle(r)
+	if !ok {
+		failCode(w, http.StatusUnsupportedMediaType)
+		return false
+	}
+
+	if err := codec.NewDecoder(r.Body, h).Decode(v); err != nil {
+		failErr(w, err)
+		return false
+	}
+	return true
+}
+
+// encodeResponse writes v as the response body in the format negotiated from
+// the Accept header, or responds 406 if we can't produce any of them.
+func encodeResponse(w http.ResponseWriter, r *http.Request, v interface{}) {
+	encodeStatus(w, r, http.StatusOK, v)
+}
+
+// encoded wraps a handler that always responds with encodeResponse or
+// encodeStatus, so that a client which can't accept any of our formats gets
+// its 406 before the handler has done anything.
+func encoded(handle httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		if _, _, ok := responseHandle(r); !ok {
+			failCode(w, http.StatusNotAcceptable)
+			return
+		}
+		handle(w, r, p)
+	}
+}
+
+// encodeStatus is encodeResponse with a response code other than 200.
+func encodeStatus(w http.ResponseWriter, r *http.Request, code int, v interface{}) {
+	ct, h, ok := responseHandle(r)
+	if !ok {
+		failCode(w, http.StatusNotAcceptable)
+		return
+	}
+
+	w.Header().Set("Content-Type", ct)
+	w.WriteHeader(code)
+	codec.NewEncoder(w, h).Encode(v)
+}
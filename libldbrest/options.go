@@ -0,0 +1,144 @@
+package libldbrest
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/syndtr/goleveldb/leveldb/filter"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/ugorji/go/codec"
+)
+
+// DBOptions are the leveldb options the db is opened with. Zero values leave
+// leveldb's own defaults in place.
+type DBOptions struct {
+	BlockCacheSize      int    `codec:"block_cache_size"`
+	BlockSize           int    `codec:"block_size"`
+	WriteBuffer         int    `codec:"write_buffer"`
+	CompactionTableSize int    `codec:"compaction_table_size"`
+	MaxOpenFiles        int    `codec:"max_open_files"`
+	BloomFilterBits     int    `codec:"bloom_filter_bits"`
+	Compression         string `codec:"compression"`
+	Strict              string `codec:"strict"`
+}
+
+// Options are what OpenDB opens the db with.
+var Options DBOptions
+
+var (
+	compressions = map[string]opt.Compression{
+		"snappy": opt.SnappyCompression,
+		"none":   opt.NoCompression,
+	}
+	stricts = map[string]opt.Strict{
+		"default": opt.DefaultStrict,
+		"all":     opt.StrictAll,
+		"none":    opt.NoStrict,
+	}
+)
+
+var optionNames = map[string]bool{
+	"block_cache_size":      true,
+	"block_size":            true,
+	"write_buffer":          true,
+	"compaction_table_size": true,
+	"max_open_files":        true,
+	"bloom_filter_bits":     true,
+	"compression":           true,
+	"strict":                true,
+}
+
+// LoadOptions reads options from a JSON file.
+func LoadOptions(path string) (DBOptions, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return DBOptions{}, err
+	}
+
+	o, err := ParseOptions(b)
+	if err != nil {
+		return o, fmt.Errorf("%s: %s", path, err)
+	}
+	return o, nil
+}
+
+// ParseOptions reads options from a JSON object.
+func ParseOptions(b []byte) (DBOptions, error) {
+	var o DBOptions
+
+	// catch misspellings, which would otherwise just be ignored
+	fields := map[string]interface{}{}
+	if err := codec.NewDecoderBytes(b, handles[jsonCType]).Decode(&fields); err != nil {
+		return o, err
+	}
+	for name := range fields {
+		if !optionNames[name] {
+			return o, fmt.Errorf("unknown option %q", name)
+		}
+	}
+
+	err := codec.NewDecoderBytes(b, handles[jsonCType]).Decode(&o)
+	return o, err
+}
+
+// Validate checks that the options are all usable.
+func (o *DBOptions) Validate() error {
+	sizes := []struct {
+		name string
+		val  int
+	}{
+		{"block_cache_size", o.BlockCacheSize},
+		{"block_size", o.BlockSize},
+		{"write_buffer", o.WriteBuffer},
+		{"compaction_table_size", o.CompactionTableSize},
+		{"max_open_files", o.MaxOpenFiles},
+		{"bloom_filter_bits", o.BloomFilterBits},
+	}
+	for _, size := range sizes {
+		if size.val < 0 {
+			return fmt.Errorf("%s must not be negative", size.name)
+		}
+	}
+
+	if _, ok := compressions[o.Compression]; o.Compression != "" && !ok {
+		return errors.New(`compression must be "snappy" or "none"`)
+	}
+	if _, ok := stricts[o.Strict]; o.Strict != "" && !ok {
+		return errors.New(`strict must be "default", "all" or "none"`)
+	}
+	return nil
+}
+
+// leveldb produces the options to open a db with
+func (o *DBOptions) leveldb() *opt.Options {
+	lo := &opt.Options{
+		BlockCacheCapacity:     o.BlockCacheSize,
+		BlockSize:              o.BlockSize,
+		WriteBuffer:            o.WriteBuffer,
+		CompactionTableSize:    o.CompactionTableSize,
+		OpenFilesCacheCapacity: o.MaxOpenFiles,
+		Compression:            compressions[o.Compression],
+		Strict:                 stricts[o.Strict],
+	}
+	if o.BloomFilterBits > 0 {
+		lo.Filter = filter.NewBloomFilter(o.BloomFilterBits)
+	}
+	return lo
+}
+
+// effective fills in leveldb's defaults for whatever wasn't set
+func (o *DBOptions) effective() *DBOptions {
+	lo := o.leveldb()
+	eff := *o
+	eff.BlockCacheSize = lo.GetBlockCacheCapacity()
+	eff.BlockSize = lo.GetBlockSize()
+	eff.WriteBuffer = lo.GetWriteBuffer()
+	eff.CompactionTableSize = lo.GetCompactionTableSize(0)
+	eff.MaxOpenFiles = lo.GetOpenFilesCacheCapacity()
+	eff.Compression = lo.GetCompression().String()
+	if eff.Strict == "" {
+		eff.Strict = "default"
+	}
+	return &eff
+}
@@ -0,0 +1,152 @@
+package libldbrest
+
+import (
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/ugorji/go/codec"
+)
+
+/*
+Replication works over two streaming endpoints on the primary, each sending a
+sequence of msgpack change records.
+
+The bootstrap stream begins with a "bootstrap" record holding the change log
+sequence number as of a snapshot, then a "put" for every key in the
+snapshot, then an "end" record.
+
+The replication stream sends every change logged after a given sequence
+number, and keeps on sending them as they are committed. Each change carries
+the sequence number of the last one in its txn, so that the follower can
+apply the txn in one go. In between it sends "heartbeat" records with the
+primary's latest sequence number and time.
+*/
+
+// how often the replication stream sends a heartbeat
+var heartbeatInterval = time.Second
+
+// snapshotWithSeq takes a snapshot along with the change log sequence number
+// it corresponds to
+func (d *Database) snapshotWithSeq() (*leveldb.Snapshot, uint64, error) {
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+
+	snap, err := d.db.GetSnapshot()
+	if err != nil {
+		return nil, 0, err
+	}
+	return snap, atomic.LoadUint64(&d.lastSeq), nil
+}
+
+// streamBootstrap sends the complete current contents of the db
+func (d *Database) streamBootstrap(w http.ResponseWriter) {
+	snap, seq, err := d.snapshotWithSeq()
+	if err != nil {
+		failErr(w, err)
+		return
+	}
+	defer snap.Release()
+
+	w.Header().Set("Content-Type", msgpackCType)
+	enc := codec.NewEncoder(w, msgpack)
+	if err := enc.Encode(&change{Op: "bootstrap", Seq: seq}); err != nil {
+		return
+	}
+
+	expiries := newExpiryCursor(snap, false)
+	defer expiries.release()
+
+	_, err = (&iterRange{IncludeStart: true}).iterate(snap, maxInt, func(key, value []byte) error {
+		expires, err := expiries.expiry(key)
+		if err != nil {
+			return err
+		}
+		return enc.Encode(&change{
+			Op:        "put",
+			Key:       string(key),
+			Value:     string(value),
+			ExpiresAt: expires,
+		})
+	})
+	if err != nil {
+		log.Printf("replication bootstrap stopped: %s", err)
+		return
+	}
+
+	enc.Encode(&change{Op: "end", Seq: seq})
+}
+
+// streamReplication sends every change after since, and then keeps sending
+// new ones (and heartbeats) until the client goes away.
+func (d *Database) streamReplication(w http.ResponseWriter, r *http.Request, since uint64) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		failCode(w, http.StatusNotImplemented)
+		return
+	}
+
+	var gone <-chan bool
+	if cn, ok := w.(http.CloseNotifier); ok {
+		gone = cn.CloseNotify()
+	}
+
+	// check for truncation before committing to a 200
+	updated := d.logUpdates()
+	changes, first, err := d.changesSince(since, ABSMAX)
+	if err == errTruncated {
+		encodeStatus(w, r, http.StatusGone, &struct {
+			Error string `codec:"error"`
+			First uint64 `codec:"first"`
+		}{err.Error(), first})
+		return
+	} else if err != nil {
+		failErr(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", msgpackCType)
+	enc := codec.NewEncoder(w, msgpack)
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		for _, c := range changes {
+			if err := enc.Encode(c); err != nil {
+				return
+			}
+			since = c.Seq
+		}
+		flusher.Flush()
+
+		// a full page means there are likely more waiting already
+		if len(changes) < ABSMAX {
+			for waiting := true; waiting; {
+				select {
+				case <-gone:
+					return
+				case <-updated:
+					waiting = false
+				case <-heartbeat.C:
+					err := enc.Encode(&change{
+						Op:   "heartbeat",
+						Seq:  atomic.LoadUint64(&d.lastSeq),
+						Time: time.Now().Unix(),
+					})
+					if err != nil {
+						return
+					}
+					flusher.Flush()
+				}
+			}
+		}
+
+		updated = d.logUpdates()
+		if changes, _, err = d.changesSince(since, ABSMAX); err != nil {
+			log.Printf("replication stream stopped: %s", err)
+			return
+		}
+	}
+}
@@ -2,19 +2,119 @@ package libldbrest
 
 import (
 	"log"
+	"sync"
 
 	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
-var (
-	db *leveldb.DB
-)
+// Database is an open leveldb along with everything ldbrest keeps track of
+// for it. Any number of them may be served by one process.
+type Database struct {
+	db   *leveldb.DB
+	stor *holdStorage
+
+	// the directory db was opened from, and how
+	path    string
+	options DBOptions
+
+	// writeMu serializes writes, so that checking a key's current value and
+	// then writing it can happen without anyone else slipping a write in
+	// between
+	writeMu sync.Mutex
+
+	// how many keys have an expiry, so that writes needn't look any up while
+	// there are none. It is only used while holding writeMu.
+	expiring int64
+
+	// the sequence number of the latest change in the change log. It is only
+	// advanced while holding writeMu, but may be read at any time.
+	lastSeq uint64
+
+	// the sequence number the change log starts after, as the writes up to
+	// then weren't logged or have been pruned since
+	logStart uint64
+
+	logUpdated logBroadcast
+	reaper     reaper
+	snapshots  snapshotRegistry
+	watchers   watcherRegistry
+	follower   followerState
+	compaction compactor
+}
+
+// the database OpenDB, CleanupDB and InitRouter work with
+var defaultDB *Database
+
+// reader is what reads need from either the live DB or a *leveldb.Snapshot
+type reader interface {
+	Get([]byte, *opt.ReadOptions) ([]byte, error)
+	NewIterator(*util.Range, *opt.ReadOptions) iterator.Iterator
+}
+
+// Open opens the leveldb at path with the given options, and starts up
+// ldbrest's background work for it. Be sure and Close() it when done.
+func Open(path string, options DBOptions) (*Database, error) {
+	stor, err := storage.OpenFile(path)
+	if err != nil {
+		return nil, err
+	}
+	hs := &holdStorage{Storage: stor}
+
+	ldb, err := leveldb.Open(hs, options.leveldb())
+	if err != nil {
+		stor.Close()
+		return nil, err
+	}
+
+	d := &Database{
+		db:      ldb,
+		stor:    hs,
+		path:    path,
+		options: options,
+	}
+	d.logUpdated.ch = make(chan struct{})
+	d.snapshots.m = make(map[string]*leasedSnapshot)
+	d.watchers.m = make(map[*watcher]struct{})
+
+	if err := d.loadMeta(); err != nil {
+		ldb.Close()
+		stor.Close()
+		return nil, err
+	}
+	d.startReaper()
+	return d, nil
+}
+
+// loadMeta picks up ldbrest's own state from the reserved range of a freshly
+// opened db.
+func (d *Database) loadMeta() error {
+	if err := d.loadExpiries(); err != nil {
+		return err
+	}
+	return d.loadChangeLog()
+}
+
+// Close stops everything going on for the database, and closes it.
+func (d *Database) Close() error {
+	d.stopFollowing()
+	d.stopReaper()
+	d.releaseSnapshots()
+	err := d.db.Close()
+	if serr := d.stor.Close(); err == nil {
+		err = serr
+	}
+	return err
+}
 
 // OpenDB intializes global vars for the leveldb database.
 // Be sure and call CleanupDB() to free those resources.
 func OpenDB(dbpath string) {
 	var err error
-	db, err = leveldb.OpenFile(dbpath, nil)
+	defaultDB, err = Open(dbpath, Options)
 	if err != nil {
 		log.Fatalf("opening leveldb: %s", err)
 	}
@@ -22,6 +122,6 @@ func OpenDB(dbpath string) {
 
 // CleanupDB frees the global vars associated with the open leveldb.
 func CleanupDB() {
-	db.Close()
-	db = nil
+	defaultDB.Close()
+	defaultDB = nil
 }
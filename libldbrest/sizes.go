@@ -0,0 +1,128 @@
+package libldbrest
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// how many ranges go to each db.SizeOf call when grouping by delimiter
+const sizeChunk = 1000
+
+var errBadSizes = errors.New("bad sizes request")
+
+// sizeRange is a range or prefix to estimate the on-disk size of
+type sizeRange struct {
+	Start  string `codec:"start,omitempty"`
+	End    string `codec:"end,omitempty"`
+	Prefix string `codec:"prefix,omitempty"`
+	Size   uint64 `codec:"size"`
+}
+
+func (sr *sizeRange) bounds() util.Range {
+	ir := &iterRange{Start: sr.Start, End: sr.End, Prefix: sr.Prefix}
+	return *ir.bounds()
+}
+
+// rangeSizes fills in the size of each range
+func (d *Database) rangeSizes(ranges []*sizeRange) error {
+	rngs := make([]util.Range, len(ranges))
+	for i, sr := range ranges {
+		rngs[i] = sr.bounds()
+	}
+
+	sizes, err := userSizeOf(d.db, rngs)
+	if err != nil {
+		return err
+	}
+	for i, size := range sizes {
+		ranges[i].Size = size
+	}
+	return nil
+}
+
+// topPrefixes splits the keys beginning with prefix into groups by the next
+// occurrence of delim, and returns the top n groups by size. A key without
+// delim after the prefix is a group of its own.
+func (d *Database) topPrefixes(prefix, delim []byte, n int) ([]*sizeRange, error) {
+	if len(delim) == 0 || n <= 0 {
+		return nil, errBadSizes
+	}
+
+	iter := newUserIterator(d.db, util.BytesPrefix(prefix), &opt.ReadOptions{
+		DontFillCache: true,
+	})
+	defer iter.Release()
+
+	var (
+		top    = make([]*sizeRange, 0, n+sizeChunk)
+		groups = make([]*sizeRange, 0, sizeChunk)
+		rngs   = make([]util.Range, 0, sizeChunk)
+	)
+
+	measure := func() error {
+		sizes, err := userSizeOf(d.db, rngs)
+		if err != nil {
+			return err
+		}
+		for i, size := range sizes {
+			groups[i].Size = size
+		}
+
+		top = append(top, groups...)
+		sort.Stable(bySize(top))
+		if len(top) > n {
+			top = top[:n]
+		}
+		groups, rngs = groups[:0], rngs[:0]
+		return nil
+	}
+
+	for iter.First(); iter.Valid(); {
+		key := iter.Key()
+
+		var rng util.Range
+		i := bytes.Index(key[len(prefix):], delim)
+		if i < 0 {
+			rng = util.Range{
+				Start: append([]byte{}, key...),
+				Limit: append(append([]byte{}, key...), 0),
+			}
+			iter.Next()
+		} else {
+			rng = *util.BytesPrefix(append([]byte{}, key[:len(prefix)+i+len(delim)]...))
+			// skip past the rest of the group
+			if rng.Limit != nil {
+				iter.Seek(rng.Limit)
+			} else {
+				iter.Last()
+				iter.Next()
+			}
+		}
+
+		groups = append(groups, &sizeRange{Prefix: string(rng.Start)})
+		rngs = append(rngs, rng)
+		if len(groups) == sizeChunk {
+			if err := measure(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+
+	if err := measure(); err != nil {
+		return nil, err
+	}
+	return top, nil
+}
+
+type bySize []*sizeRange
+
+func (bs bySize) Len() int           { return len(bs) }
+func (bs bySize) Less(i, j int) bool { return bs[i].Size > bs[j].Size }
+func (bs bySize) Swap(i, j int)      { bs[i], bs[j] = bs[j], bs[i] }
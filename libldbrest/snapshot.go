@@ -1,15 +1,44 @@
 package libldbrest
 
 import (
+	"errors"
+	"log"
 	"os"
 
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/opt"
 )
 
-func makeSnap(destpath string) error {
+var errBadSnapMode = errors.New("bad snapshot mode")
+
+// makeSnap copies the db to destpath, which mustn't exist yet. The
+// "checkpoint" mode links the db's files, falling back to a "logical" copy of
+// every key if it keeps racing compactions. Any other failure is returned.
+func (d *Database) makeSnap(destpath, mode string) error {
+	switch mode {
+	case "", "checkpoint":
+		err := d.checkpoint(destpath)
+		if err != errCheckpointRaced {
+			return err
+		}
+		log.Printf("checkpoint to %s failed, making a logical copy: %s", destpath, err)
+		return d.copySnap(destpath)
+	case "logical":
+		return d.copySnap(destpath)
+	default:
+		return errBadSnapMode
+	}
+}
+
+// copySnap writes every key from a point-in-time snapshot into a new db at
+// destpath, which mustn't exist yet
+func (d *Database) copySnap(destpath string) error {
+	if err := os.Mkdir(destpath, 0755); err != nil {
+		return err
+	}
 	dest, err := leveldb.OpenFile(destpath, nil)
 	if err != nil {
+		os.RemoveAll(destpath)
 		return err
 	}
 	failed := false
@@ -20,7 +49,7 @@ func makeSnap(destpath string) error {
 		}
 	}()
 
-	snap, err := db.GetSnapshot()
+	snap, err := d.db.GetSnapshot()
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,129 @@
+package libldbrest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+var (
+	// DefaultSnapshotLease is how long a named snapshot lives without being
+	// used, when its creator didn't ask for anything different.
+	DefaultSnapshotLease = time.Minute
+
+	// MaxSnapshotLease is the longest lease a named snapshot may be given.
+	MaxSnapshotLease = time.Hour
+)
+
+// leasedSnapshot is a named snapshot that is released once it goes unused
+// for the length of its lease
+type leasedSnapshot struct {
+	*leveldb.Snapshot
+	d     *Database
+	id    string
+	lease time.Duration
+	timer *time.Timer
+
+	// requests currently reading from the snapshot, and whether it has
+	// expired or been deleted (with those requests holding off the release)
+	users   int
+	expired bool
+}
+
+// snapshotRegistry holds a database's named snapshots by id
+type snapshotRegistry struct {
+	sync.Mutex
+	m map[string]*leasedSnapshot
+}
+
+// newSnapshot takes a snapshot of the db and registers it under a new id
+func (d *Database) newSnapshot(lease time.Duration) (*leasedSnapshot, error) {
+	idb := make([]byte, 16)
+	if _, err := rand.Read(idb); err != nil {
+		return nil, err
+	}
+
+	snap, err := d.db.GetSnapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	ls := &leasedSnapshot{
+		Snapshot: snap,
+		d:        d,
+		id:       hex.EncodeToString(idb),
+		lease:    lease,
+	}
+
+	d.snapshots.Lock()
+	defer d.snapshots.Unlock()
+
+	d.snapshots.m[ls.id] = ls
+	ls.timer = time.AfterFunc(lease, func() {
+		d.expireSnapshot(ls.id)
+	})
+	return ls, nil
+}
+
+// acquireSnapshot looks up a named snapshot for a request to read from,
+// renewing its lease. Call done() on it when finished.
+func (d *Database) acquireSnapshot(id string) (*leasedSnapshot, bool) {
+	d.snapshots.Lock()
+	defer d.snapshots.Unlock()
+
+	ls, ok := d.snapshots.m[id]
+	if !ok {
+		return nil, false
+	}
+
+	ls.users++
+	ls.timer.Reset(ls.lease)
+	return ls, true
+}
+
+func (ls *leasedSnapshot) done() {
+	ls.d.snapshots.Lock()
+	defer ls.d.snapshots.Unlock()
+
+	ls.users--
+	if ls.expired && ls.users == 0 {
+		ls.Release()
+	}
+}
+
+// expireSnapshot drops a named snapshot, releasing it as soon as nobody is
+// reading from it. It reports whether there was such a snapshot.
+func (d *Database) expireSnapshot(id string) bool {
+	d.snapshots.Lock()
+	defer d.snapshots.Unlock()
+
+	ls, ok := d.snapshots.m[id]
+	if !ok {
+		return false
+	}
+
+	delete(d.snapshots.m, id)
+	ls.timer.Stop()
+	ls.expired = true
+	if ls.users == 0 {
+		ls.Release()
+	}
+	return true
+}
+
+// releaseSnapshots drops every named snapshot
+func (d *Database) releaseSnapshots() {
+	d.snapshots.Lock()
+	ids := make([]string, 0, len(d.snapshots.m))
+	for id := range d.snapshots.m {
+		ids = append(ids, id)
+	}
+	d.snapshots.Unlock()
+
+	for _, id := range ids {
+		d.expireSnapshot(id)
+	}
+}
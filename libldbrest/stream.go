@@ -0,0 +1,101 @@
+package libldbrest
+
+import (
+	"errors"
+	"log"
+	"mime"
+	"net/http"
+
+	"github.com/ugorji/go/codec"
+)
+
+const (
+	// flush the response to the client after this many streamed records
+	streamFlushEvery = 100
+
+	maxInt = int(^uint(0) >> 1)
+)
+
+var errClientGone = errors.New("client went away")
+
+// streamHandle picks the content-type and codec for a streamed response.
+// Streams of JSON are sent as newline-delimited JSON.
+func streamHandle(r *http.Request) (string, codec.Handle, bool) {
+	for _, mt := range acceptedTypes(r.Header.Get("Accept")) {
+		if mt == ndjsonCType {
+			return ndjsonCType, handles[jsonCType], true
+		}
+		if _, ok := handles[mt]; ok {
+			break
+		}
+	}
+
+	ct, h, ok := responseHandle(r)
+	if ct == jsonCType {
+		ct = ndjsonCType
+	}
+	return ct, h, ok
+}
+
+// streamRequestHandle picks the codec for a streamed request body, which may
+// also be newline-delimited JSON.
+func streamRequestHandle(r *http.Request) (codec.Handle, bool) {
+	mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err == nil && mt == ndjsonCType {
+		return handles[jsonCType], true
+	}
+	return requestHandle(r)
+}
+
+// streamItems writes every record of the iteration to the client as it goes
+// rather than collecting them into a single response body. With no
+// Content-Length this goes out with chunked transfer encoding.
+func streamItems(w http.ResponseWriter, r *http.Request, src reader, ir *iterRange, max int, fields fieldSet) {
+	ct, h, ok := streamHandle(r)
+	if !ok {
+		failCode(w, http.StatusNotAcceptable)
+		return
+	}
+	w.Header().Set("Content-Type", ct)
+
+	var gone <-chan bool
+	if cn, ok := w.(http.CloseNotifier); ok {
+		gone = cn.CloseNotify()
+	}
+	flusher, _ := w.(http.Flusher)
+
+	enc := codec.NewEncoder(w, h)
+	var i int
+
+	_, err := ir.iterate(src, max, func(key, value []byte) error {
+		select {
+		case <-gone:
+			return errClientGone
+		default:
+		}
+
+		if err := enc.Encode(fields.record(string(key), string(value))); err != nil {
+			return err
+		}
+		if ct == ndjsonCType {
+			if _, err := w.Write([]byte("\n")); err != nil {
+				return err
+			}
+		}
+
+		i++
+		if flusher != nil && i%streamFlushEvery == 0 {
+			flusher.Flush()
+		}
+		return nil
+	})
+
+	// too late to change the response code, so all we can do is log
+	if err != nil {
+		log.Printf("streaming iteration stopped: %s", err)
+		return
+	}
+	if flusher != nil {
+		flusher.Flush()
+	}
+}
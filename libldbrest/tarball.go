@@ -0,0 +1,78 @@
+package libldbrest
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// writeTar archives the files captured for a checkpoint, gzipped if asked,
+// reading the tables straight out of the db's directory. The caller must have
+// a hold on the storage until it's done.
+func (d *Database) writeTar(w io.Writer, files *dbFiles, gz bool) error {
+	if gz {
+		zw := gzip.NewWriter(w)
+		defer zw.Close()
+		w = zw
+	}
+	tw := tar.NewWriter(w)
+
+	now := time.Now()
+	for _, cf := range files.copies {
+		if err := writeTarData(tw, cf.name, cf.data, now); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range files.tables {
+		f, err := os.Open(filepath.Join(d.path, name))
+		if err != nil {
+			return err
+		}
+		err = writeTarFile(tw, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	// CURRENT goes in last, as it is what makes the directory a db
+	if err := writeTarData(tw, "CURRENT", files.current, now); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+func writeTarData(tw *tar.Writer, name string, data []byte, mtime time.Time) error {
+	err := tw.WriteHeader(&tar.Header{
+		Name:     name,
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Size:     int64(len(data)),
+		ModTime:  mtime,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(data)
+	return err
+}
+
+func writeTarFile(tw *tar.Writer, f *os.File) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr, err := tar.FileInfoHeader(fi, "")
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.CopyN(tw, f, hdr.Size)
+	return err
+}
@@ -0,0 +1,280 @@
+package libldbrest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// ReapInterval is how often the background reaper deletes expired keys
+// (and prunes the change log).
+var ReapInterval = 10 * time.Second
+
+var errBadExpiry = errors.New("bad ttl or expires_at")
+
+/*
+Expiries are kept in two sections of the reserved range:
+
+"ttl/<key>" holds a key's expiry (as 8 big-endian bytes of unix time) so it
+can be looked up, and "expiries/<expiry><key>" is an index ordered by expiry,
+so the reaper can find what's due.
+*/
+
+func expiryKey(key []byte) []byte {
+	return metaKey("ttl", key)
+}
+
+func expiryIndexKey(expires int64, key []byte) []byte {
+	return metaKey("expiries", encodeExpiry(expires), key)
+}
+
+func encodeExpiry(expires int64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(expires))
+	return b
+}
+
+func decodeExpiry(b []byte) int64 {
+	return int64(binary.BigEndian.Uint64(b))
+}
+
+// loadExpiries counts the expiring keys in the freshly opened db
+func (d *Database) loadExpiries() error {
+	iter := d.db.NewIterator(util.BytesPrefix(expiryKey(nil)), &opt.ReadOptions{
+		DontFillCache: true,
+	})
+	defer iter.Release()
+
+	for iter.First(); iter.Valid(); iter.Next() {
+		d.expiring++
+	}
+	return iter.Error()
+}
+
+// expiryOf gets a key's expiry as a unix time, or 0 if it has none
+func expiryOf(src reader, key []byte) (int64, error) {
+	b, err := src.Get(expiryKey(key), nil)
+	if err == leveldb.ErrNotFound {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return decodeExpiry(b), nil
+}
+
+func isExpired(src reader, key []byte, now int64) (bool, error) {
+	exp, err := expiryOf(src, key)
+	return exp != 0 && exp <= now, err
+}
+
+// expiryCursor finds the expiries of keys that are visited in order, by
+// walking through the "ttl/" section alongside them instead of looking each
+// one up.
+type expiryCursor struct {
+	iter      iterator.Iterator
+	backwards bool
+	started   bool
+}
+
+func newExpiryCursor(src reader, backwards bool) *expiryCursor {
+	return &expiryCursor{
+		iter: src.NewIterator(util.BytesPrefix(expiryKey(nil)), &opt.ReadOptions{
+			DontFillCache: true,
+		}),
+		backwards: backwards,
+	}
+}
+
+// expiry gets key's expiry as a unix time, or 0 if it has none. Each key must
+// come after (or going backwards, before) the last one.
+func (ec *expiryCursor) expiry(key []byte) (int64, error) {
+	target := expiryKey(key)
+	if !ec.started {
+		ec.started = true
+		ec.iter.Seek(target)
+		if ec.backwards {
+			if !ec.iter.Valid() {
+				ec.iter.Last()
+			} else if bytes.Compare(ec.iter.Key(), target) > 0 {
+				ec.iter.Prev()
+			}
+		}
+	} else if ec.backwards {
+		for ec.iter.Valid() && bytes.Compare(ec.iter.Key(), target) > 0 {
+			ec.iter.Prev()
+		}
+	} else {
+		for ec.iter.Valid() && bytes.Compare(ec.iter.Key(), target) < 0 {
+			ec.iter.Next()
+		}
+	}
+
+	if !ec.iter.Valid() || !bytes.Equal(ec.iter.Key(), target) {
+		return 0, ec.iter.Error()
+	}
+	return decodeExpiry(ec.iter.Value()), nil
+}
+
+func (ec *expiryCursor) isExpired(key []byte, now int64) (bool, error) {
+	exp, err := ec.expiry(key)
+	return exp != 0 && exp <= now, err
+}
+
+func (ec *expiryCursor) release() {
+	ec.iter.Release()
+}
+
+// get is src.Get, except that reserved keys and expired (but not yet reaped)
+// keys are treated as missing.
+func get(src reader, key []byte) ([]byte, error) {
+	if isReserved(key) {
+		return nil, leveldb.ErrNotFound
+	}
+
+	val, err := src.Get(key, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	expired, err := isExpired(src, key, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	if expired {
+		return nil, leveldb.ErrNotFound
+	}
+	return val, nil
+}
+
+// expiresAt works out an expiry from a ttl in seconds or an absolute unix time
+// (which takes precedence). It's 0, for no expiry, if neither was given.
+func expiresAt(ttl, at int64) (int64, error) {
+	if ttl < 0 || at < 0 {
+		return 0, errBadExpiry
+	}
+	if at != 0 {
+		return at, nil
+	}
+	if ttl != 0 {
+		return time.Now().Unix() + ttl, nil
+	}
+	return 0, nil
+}
+
+// expiryFromQuery is expiresAt with "ttl" and "expires_at" query parameters
+func expiryFromQuery(q url.Values) (int64, error) {
+	var ttl, at int64
+	var err error
+
+	if s := q.Get("ttl"); s != "" {
+		if ttl, err = strconv.ParseInt(s, 10, 64); err != nil {
+			return 0, errBadExpiry
+		}
+	}
+	if s := q.Get("expires_at"); s != "" {
+		if at, err = strconv.ParseInt(s, 10, 64); err != nil {
+			return 0, errBadExpiry
+		}
+	}
+
+	return expiresAt(ttl, at)
+}
+
+// reapExpired deletes every key that expired as of now, in batches, and
+// returns how many there were.
+func (d *Database) reapExpired(now int64) (int, error) {
+	var total int
+	for {
+		n, err := d.reapBatch(now)
+		total += n
+		if err != nil || n < deleteBatchSize {
+			return total, err
+		}
+	}
+}
+
+func (d *Database) reapBatch(now int64) (int, error) {
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+
+	prefix := metaKey("expiries")
+	iter := d.db.NewIterator(
+		&util.Range{Start: prefix, Limit: expiryIndexKey(now+1, nil)},
+		&opt.ReadOptions{
+			DontFillCache: true,
+		},
+	)
+	defer iter.Release()
+
+	t := d.newTxn()
+	var n int
+	for iter.First(); iter.Valid() && n < deleteBatchSize; iter.Next() {
+		key := append([]byte{}, iter.Key()[len(prefix)+8:]...)
+		if err := t.del(key); err != nil {
+			return 0, err
+		}
+		n++
+	}
+	if err := iter.Error(); err != nil {
+		return 0, err
+	}
+
+	if n == 0 {
+		return 0, nil
+	}
+	return n, t.write()
+}
+
+// reaper is a database's background reaping goroutine, while it runs
+type reaper struct {
+	stop, done chan struct{}
+}
+
+// startReaper runs reapExpired and pruneChanges every ReapInterval in the
+// background
+func (d *Database) startReaper() {
+	d.reaper.stop = make(chan struct{})
+	d.reaper.done = make(chan struct{})
+
+	go func(stop, done chan struct{}) {
+		defer close(done)
+		ticker := time.NewTicker(ReapInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				// a follower gets its primary's reaping through replication
+				if !d.isFollowing() {
+					if _, err := d.reapExpired(time.Now().Unix()); err != nil {
+						log.Printf("reaping expired keys: %s", err)
+					}
+				}
+				if _, err := d.pruneChanges(time.Now()); err != nil {
+					log.Printf("pruning the change log: %s", err)
+				}
+			}
+		}
+	}(d.reaper.stop, d.reaper.done)
+}
+
+// stopReaper stops the background reaper and waits for it to finish up
+func (d *Database) stopReaper() {
+	if d.reaper.stop == nil {
+		return
+	}
+	close(d.reaper.stop)
+	<-d.reaper.done
+	d.reaper.stop, d.reaper.done = nil, nil
+}
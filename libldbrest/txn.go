@@ -0,0 +1,139 @@
+package libldbrest
+
+import (
+	"sync/atomic"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// txn accumulates a batch of client writes, along with the bookkeeping in the
+// reserved range that goes with them, and writes it all atomically.
+// It must only be used while holding its database's writeMu.
+type txn struct {
+	d     *Database
+	batch *leveldb.Batch
+
+	// expiries of the keys already written in this txn (0 for none), and how
+	// that changes the number of expiring keys
+	expiries map[string]int64
+	expiring int64
+
+	// the client-visible writes, in order
+	changes []*change
+
+	// set to write the batch without logging or publishing its changes, which
+	// cuts off the change log before it instead
+	unlogged bool
+}
+
+func (d *Database) newTxn() *txn {
+	return &txn{
+		d:        d,
+		batch:    &leveldb.Batch{},
+		expiries: make(map[string]int64),
+		changes:  make([]*change, 0),
+	}
+}
+
+// expiry gets a key's expiry as of this txn's writes so far
+func (t *txn) expiry(key []byte) (int64, error) {
+	if exp, ok := t.expiries[string(key)]; ok {
+		return exp, nil
+	}
+	if t.d.expiring == 0 {
+		return 0, nil
+	}
+	return expiryOf(t.d.db, key)
+}
+
+// put sets a key's value and its expiry (0 for never)
+func (t *txn) put(key, value []byte, expires int64) error {
+	if isReserved(key) {
+		return errReservedKey
+	}
+
+	if err := t.setExpiry(key, expires); err != nil {
+		return err
+	}
+	t.batch.Put(key, value)
+	t.changes = append(t.changes, &change{
+		Op:        "put",
+		Key:       string(key),
+		Value:     string(value),
+		ExpiresAt: expires,
+	})
+	return nil
+}
+
+// del deletes a key
+func (t *txn) del(key []byte) error {
+	if isReserved(key) {
+		return errReservedKey
+	}
+
+	if err := t.setExpiry(key, 0); err != nil {
+		return err
+	}
+	t.batch.Delete(key)
+	t.changes = append(t.changes, &change{Op: "delete", Key: string(key)})
+	return nil
+}
+
+func (t *txn) setExpiry(key []byte, expires int64) error {
+	old, err := t.expiry(key)
+	if err != nil {
+		return err
+	}
+
+	if old != 0 {
+		t.batch.Delete(expiryIndexKey(old, key))
+		if expires == 0 {
+			t.batch.Delete(expiryKey(key))
+			t.expiring--
+		}
+	}
+	if expires != 0 {
+		t.batch.Put(expiryKey(key), encodeExpiry(expires))
+		t.batch.Put(expiryIndexKey(expires, key), nil)
+		if old == 0 {
+			t.expiring++
+		}
+	}
+
+	t.expiries[string(key)] = expires
+	return nil
+}
+
+func (t *txn) write() error {
+	if t.unlogged {
+		if t.batch.Len() == 0 {
+			return nil
+		}
+		seq := t.d.breakChangeLog(t)
+		if err := t.d.db.Write(t.batch, nil); err != nil {
+			return err
+		}
+		t.d.expiring += t.expiring
+		atomic.StoreUint64(&t.d.logStart, seq)
+		atomic.StoreUint64(&t.d.lastSeq, seq)
+
+		// wake up anyone reading the log, to find it cut off, and let
+		// watchers know they've missed out
+		t.d.notifyLogUpdated()
+		t.d.dropWatchers(droppedUnlogged)
+		return nil
+	}
+
+	seq := t.d.logChanges(t)
+	if err := t.d.db.Write(t.batch, nil); err != nil {
+		return err
+	}
+	t.d.expiring += t.expiring
+	atomic.StoreUint64(&t.d.lastSeq, seq)
+
+	if len(t.changes) > 0 {
+		t.d.notifyLogUpdated()
+		t.d.publish(t.changes)
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package libldbrest
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/ugorji/go/codec"
+)
+
+// how many changes may queue up for a watcher before it is dropped
+const watchBuffer = 1000
+
+// why watchers get dropped, as told to their clients
+const (
+	droppedBehind   = "watcher fell too far behind"
+	droppedUnlogged = "keys were changed without being logged"
+)
+
+// change is a single client-visible write
+type change struct {
+	Seq       uint64 `codec:"seq,omitempty"`
+	Time      int64  `codec:"time,omitempty"`
+	Op        string `codec:"op"`
+	Key       string `codec:"key"`
+	Value     string `codec:"value,omitempty"`
+	ExpiresAt int64  `codec:"expires_at,omitempty"`
+
+	// the sequence number of the last change written along with this one,
+	// so that they can be applied together
+	Txn uint64 `codec:"txn,omitempty"`
+}
+
+type watcher struct {
+	prefix string
+	ch     chan *change
+
+	// why it was dropped, set before ch is closed
+	dropped string
+}
+
+// watcherRegistry holds a database's watchers
+type watcherRegistry struct {
+	sync.Mutex
+	m map[*watcher]struct{}
+}
+
+func (d *Database) addWatcher(prefix string) *watcher {
+	wt := &watcher{prefix: prefix, ch: make(chan *change, watchBuffer)}
+
+	d.watchers.Lock()
+	defer d.watchers.Unlock()
+	d.watchers.m[wt] = struct{}{}
+	return wt
+}
+
+// removeWatcher unregisters a watcher and closes its channel, if that hasn't
+// happened already
+func (d *Database) removeWatcher(wt *watcher) {
+	d.watchers.Lock()
+	defer d.watchers.Unlock()
+	if _, ok := d.watchers.m[wt]; ok {
+		delete(d.watchers.m, wt)
+		close(wt.ch)
+	}
+}
+
+// publish hands changes out to interested watchers. It never blocks: a watcher
+// too far behind to take another change is dropped, which it will find out
+// about when its channel closes.
+func (d *Database) publish(changes []*change) {
+	d.watchers.Lock()
+	defer d.watchers.Unlock()
+
+	for wt := range d.watchers.m {
+		for _, c := range changes {
+			if !strings.HasPrefix(c.Key, wt.prefix) {
+				continue
+			}
+
+			select {
+			case wt.ch <- c:
+				continue
+			default:
+			}
+
+			d.dropWatcher(wt, droppedBehind)
+			break
+		}
+	}
+}
+
+// dropWatchers drops every watcher, for when keys have changed in ways they
+// can't be told about one by one
+func (d *Database) dropWatchers(why string) {
+	d.watchers.Lock()
+	defer d.watchers.Unlock()
+
+	for wt := range d.watchers.m {
+		d.dropWatcher(wt, why)
+	}
+}
+
+// dropWatcher must be called holding the watchers lock
+func (d *Database) dropWatcher(wt *watcher, why string) {
+	wt.dropped = why
+	delete(d.watchers.m, wt)
+	close(wt.ch)
+}
+
+// streamChanges sends a watcher's changes to the client as server-sent events
+// until either the client goes away or the watcher is dropped.
+func streamChanges(w http.ResponseWriter, wt *watcher, values bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		failCode(w, http.StatusNotImplemented)
+		return
+	}
+
+	var gone <-chan bool
+	if cn, ok := w.(http.CloseNotifier); ok {
+		gone = cn.CloseNotify()
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	buf := &bytes.Buffer{}
+	json := handles[jsonCType]
+
+	for {
+		select {
+		case <-gone:
+			return
+		case c, ok := <-wt.ch:
+			if !ok {
+				w.Write([]byte("event: dropped\ndata: " + wt.dropped + "\n\n"))
+				flusher.Flush()
+				return
+			}
+
+			if !values {
+				stripped := *c
+				stripped.Value = ""
+				c = &stripped
+			}
+
+			buf.Reset()
+			buf.WriteString("event: " + c.Op + "\ndata: ")
+			codec.NewEncoder(buf, json).Encode(c)
+			buf.WriteString("\n\n")
+			if _, err := w.Write(buf.Bytes()); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
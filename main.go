@@ -1,15 +1,31 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"log"
 	"net"
 	"net/http"
+	"sort"
 	"strings"
+	"sync"
 
+	"github.com/julienschmidt/httprouter"
 	lib "github.com/restlessbandit/ldbrest/libldbrest"
 )
 
+// tokenlist supports multiple -auth-token and -read-token flags
+type tokenlist []string
+
+func (tl *tokenlist) String() string {
+	return strings.Join(*tl, ", ")
+}
+
+func (tl *tokenlist) Set(token string) error {
+	*tl = append(*tl, token)
+	return nil
+}
+
 // addrlist to support the flag.Value interface
 // and support multiple "serveaddr"s
 type addrlist []string
@@ -23,16 +39,88 @@ func (al *addrlist) Set(addr string) error {
 	return nil
 }
 
+// dbSpec is a named database to serve under /db/<name>, from a -db flag or
+// the config file's "databases"
+type dbSpec struct {
+	Path    string                 `codec:"path"`
+	Follow  string                 `codec:"follow"`
+	Options map[string]interface{} `codec:"options"`
+}
+
+// dblist supports multiple -db name=/path flags
+type dblist map[string]*dbSpec
+
+func (dl dblist) String() string {
+	specs := make([]string, 0, len(dl))
+	for _, name := range dl.names() {
+		specs = append(specs, name+"="+dl[name].Path)
+	}
+	return strings.Join(specs, ", ")
+}
+
+func (dl dblist) Set(spec string) error {
+	i := strings.Index(spec, "=")
+	if i < 0 {
+		return errors.New("must be name=/path/to/leveldb")
+	}
+
+	name, path := spec[:i], spec[i+1:]
+	if dl[name] == nil {
+		dl[name] = &dbSpec{}
+	}
+	dl[name].Path = path
+	return nil
+}
+
+func (dl dblist) names() []string {
+	names := make([]string, 0, len(dl))
+	for name := range dl {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// databases are the named databases, from -db flags and the config file
+var databases = dblist{}
+
 // serveAddrs is the addrlist that captures -s and -serveaddr flags
 var serveAddrs addrlist
 
+// followURL is the primary to replicate from, if any
+var followURL string
+
+// optionsPath is a JSON file of leveldb options, if any
+var optionsPath string
+
+// configPath is a JSON config file, if any
+var configPath string
+
+// checkConfig says to just validate the configuration and exit
+var checkConfig bool
+
+// dbPath is where the leveldb is, from the command line or config file
+var dbPath string
+
+// the flags that may be given more than once, adding to a list
+var listFlags = map[string]bool{
+	"s":          true,
+	"serveaddr":  true,
+	"auth-token": true,
+	"read-token": true,
+	"db":         true,
+}
+
 func main() {
 	parseFlags()
 
-	if flag.NArg() == 0 {
-		log.Fatal("missing db path cmdline argument")
+	if err := validateConfig(); err != nil {
+		log.Fatal(err)
+	}
+	if checkConfig {
+		log.Print("configuration is valid")
+		return
 	}
-	path := flag.Args()[0]
 
 	unavailable := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/plain")
@@ -42,15 +130,63 @@ func main() {
 	container := &lib.SwappableHandler{}
 	container.Store(unavailable)
 
+	dbs := &openDBs{}
 	go func() {
-		lib.OpenDB(path)
-		container.Store(lib.InitRouter(""))
+		container.Store(dbs.open())
 	}()
-	defer lib.CleanupDB()
+	defer dbs.close()
 
 	run(container)
 }
 
+// openDBs keeps track of the databases being served, to close them
+type openDBs struct {
+	sync.Mutex
+	dbs []*lib.Database
+}
+
+// open opens the positional (or config file) db to serve at the root, and
+// each named database under /db/<name>, and returns a router for them all
+func (od *openDBs) open() http.Handler {
+	router := lib.NewRouter()
+	if dbPath != "" {
+		od.mount(router, "", dbPath, followURL, lib.Options)
+	}
+	for _, name := range databases.names() {
+		spec := databases[name]
+		opts, err := spec.options()
+		if err != nil {
+			log.Fatalf("database %s: %s", name, err)
+		}
+		od.mount(router, "/db/"+name, spec.Path, spec.Follow, opts)
+	}
+	return router
+}
+
+func (od *openDBs) mount(router *httprouter.Router, prefix, path, follow string, opts lib.DBOptions) {
+	d, err := lib.Open(path, opts)
+	if err != nil {
+		log.Fatalf("opening leveldb %s: %s", path, err)
+	}
+	if follow != "" {
+		d.Follow(follow)
+	}
+	d.AddRoutes(router, prefix)
+
+	od.Lock()
+	defer od.Unlock()
+	od.dbs = append(od.dbs, d)
+}
+
+func (od *openDBs) close() {
+	od.Lock()
+	defer od.Unlock()
+	for _, d := range od.dbs {
+		d.Close()
+	}
+	od.dbs = nil
+}
+
 func parseFlags() {
 	// direct -s and -serveaddr flags at serveAddrs
 	flag.Var(
@@ -64,7 +200,165 @@ func parseFlags() {
 		"[host]:port or /path/to/socket of where to run the server. may be provided more than once",
 	)
 
+	flag.IntVar(
+		&lib.ChangeLogMaxCount,
+		"changelog-count",
+		lib.ChangeLogMaxCount,
+		"number of most recent changes to retain in the change log (0 for no limit)",
+	)
+	flag.DurationVar(
+		&lib.ChangeLogMaxAge,
+		"changelog-age",
+		lib.ChangeLogMaxAge,
+		"how long to retain changes in the change log (0 for no limit)",
+	)
+
+	flag.Var(
+		databases,
+		"db",
+		"name=/path/to/leveldb of a database to serve under /db/<name>. may be provided more than once",
+	)
+
+	flag.StringVar(
+		&followURL,
+		"follow",
+		"",
+		"base url of an ldbrest primary to run as a read-only replica of",
+	)
+	flag.StringVar(
+		&lib.FollowToken,
+		"follow-token",
+		"",
+		"bearer token to send to the primary when following",
+	)
+
+	flag.StringVar(
+		&configPath,
+		"config",
+		"",
+		"JSON config file. flags given on the command line take precedence over it",
+	)
+	flag.BoolVar(
+		&checkConfig,
+		"check-config",
+		false,
+		"validate the configuration and exit",
+	)
+
+	flag.Var(
+		(*tokenlist)(&lib.AuthTokens),
+		"auth-token",
+		"bearer token that allows all requests. may be provided more than once",
+	)
+	flag.Var(
+		(*tokenlist)(&lib.ReadTokens),
+		"read-token",
+		"bearer token that allows only reads. may be provided more than once",
+	)
+
+	flag.IntVar(
+		&lib.ABSMAX,
+		"max-results",
+		lib.ABSMAX,
+		"most records in a page of results",
+	)
+	flag.IntVar(
+		&lib.KEYSMAX,
+		"max-keys",
+		lib.KEYSMAX,
+		"most keys in a page of bare keys",
+	)
+	flag.IntVar(
+		&lib.MaxBatchOps,
+		"max-batch",
+		lib.MaxBatchOps,
+		"most ops in a single batch",
+	)
+
+	flag.StringVar(
+		&optionsPath,
+		"options",
+		"",
+		"JSON file of leveldb options, with the same names as their flags (but with underscores)",
+	)
+	flag.IntVar(
+		&lib.Options.BlockCacheSize,
+		"block-cache-size",
+		0,
+		"bytes of uncompressed blocks to cache (0 for leveldb's default)",
+	)
+	flag.IntVar(
+		&lib.Options.BlockSize,
+		"block-size",
+		0,
+		"bytes of keys and values per uncompressed block (0 for leveldb's default)",
+	)
+	flag.IntVar(
+		&lib.Options.WriteBuffer,
+		"write-buffer",
+		0,
+		"bytes of writes to buffer in memory before writing a table file (0 for leveldb's default)",
+	)
+	flag.IntVar(
+		&lib.Options.CompactionTableSize,
+		"compaction-table-size",
+		0,
+		"bytes per table file written by compactions (0 for leveldb's default)",
+	)
+	flag.IntVar(
+		&lib.Options.MaxOpenFiles,
+		"max-open-files",
+		0,
+		"number of table files to keep open (0 for leveldb's default)",
+	)
+	flag.IntVar(
+		&lib.Options.BloomFilterBits,
+		"bloom-filter-bits",
+		0,
+		"bits per key of bloom filter to add to table files (0 for none)",
+	)
+	flag.StringVar(
+		&lib.Options.Compression,
+		"compression",
+		"",
+		`compression for table files, "snappy" or "none" (default "snappy")`,
+	)
+	flag.StringVar(
+		&lib.Options.Strict,
+		"strict",
+		"",
+		`how strictly to treat corruption, "default", "all" or "none"`,
+	)
+
 	flag.Parse()
+
+	// flags given on the command line take precedence over files
+	given := map[string]string{}
+	flag.Visit(func(f *flag.Flag) {
+		given[f.Name] = f.Value.String()
+	})
+
+	if configPath != "" {
+		if err := loadConfig(configPath, given); err != nil {
+			log.Fatalf("loading config %s: %s", configPath, err)
+		}
+	}
+	if optionsPath != "" {
+		opts, err := loadOptionsFile(optionsPath)
+		if err != nil {
+			log.Fatalf("loading leveldb options: %s", err)
+		}
+		lib.Options = opts
+	}
+
+	for name, value := range given {
+		if !listFlags[name] {
+			flag.Set(name, value)
+		}
+	}
+	if flag.NArg() > 0 {
+		dbPath = flag.Args()[0]
+	}
 }
 
 func run(router http.Handler) {